@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// headless command-line modes. these don't initialize SDL or open any MIDI
+// ports, so they can run in scripts and CI.
+
+const (
+	exitSuccess   = 0
+	exitError     = 1
+	exitPolyphony = 2 // output was written, but voices had to be stolen
+)
+
+const cliUsage = `usage:
+  faunatone [SONG]              open the GUI, optionally loading SONG
+  faunatone export SONG [OUT]   export SONG to a MIDI file
+  faunatone convert SONG OUT    convert SONG to the format of OUT
+
+SONG can be a .faun, .faunt, or .mid file. OUT can be a .faun, .faunt, .mid,
+.midi2 (MIDI 2.0 clip), or .wav file; it defaults to SONG with a .mid
+extension. .wav files are rendered with the built-in synth.`
+
+// if args (excluding the program name) name a headless mode, run it and
+// return its exit code and true. otherwise return false.
+func runCLI(args []string) (int, bool) {
+	if len(args) == 0 {
+		return exitSuccess, false
+	}
+	var in, out string
+	switch args[0] {
+	case "export":
+		if len(args) == 2 {
+			in = args[1]
+			out = strings.TrimSuffix(in, filepath.Ext(in)) + ".mid"
+		} else if len(args) == 3 {
+			in, out = args[1], args[2]
+		} else {
+			fmt.Fprintln(os.Stderr, cliUsage)
+			return exitError, true
+		}
+		if !strings.EqualFold(filepath.Ext(out), ".mid") {
+			fmt.Fprintf(os.Stderr, "export output must be a .mid file: %s\n", out)
+			return exitError, true
+		}
+	case "convert":
+		if len(args) != 3 {
+			fmt.Fprintln(os.Stderr, cliUsage)
+			return exitError, true
+		}
+		in, out = args[1], args[2]
+	case "help", "-h", "-help", "--help":
+		fmt.Println(cliUsage)
+		return exitSuccess, true
+	default:
+		return exitSuccess, false
+	}
+
+	settings := loadSettings(func(s string) { fmt.Fprintln(os.Stderr, s) })
+	bendSemitones = settings.PitchBendSemitones
+	exportMuteSolo = settings.ExportMuteSolo
+	synthOptions = settings.synthParams()
+	sng, err := loadSongFile(in, settings.DefaultKeymap)
+	if err == nil {
+		err = sng.writeFile(out)
+	}
+	var polyErr *polyphonyError
+	if errors.As(err, &polyErr) {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", in, err.Error())
+		return exitPolyphony, true
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", in, err.Error())
+		return exitError, true
+	}
+	return exitSuccess, true
+}
+
+// load a song from a file in any supported format, determined by extension
+func loadSongFile(path, keymapPath string) (*song, error) {
+	k, err := newKeymap(keymapPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+	sng := newSong(k)
+	return sng, sng.readFile(path)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunCLI(t *testing.T) {
+	dir := t.TempDir()
+	faunPath := filepath.Join(dir, "song.faun")
+	sng := newSong(nil)
+	sng.Tracks[0].Events = []*trackEvent{
+		{Type: noteOnEvent, FloatData: 60, ByteData1: 100},
+		{Tick: ticksPerBeat, Type: noteOffEvent},
+	}
+	f, err := os.Create(faunPath)
+	assert.Nil(t, err)
+	assert.Nil(t, sng.write(f))
+	assert.Nil(t, f.Close())
+
+	_, ok := runCLI(nil)
+	assert.False(t, ok)
+	_, ok = runCLI([]string{faunPath})
+	assert.False(t, ok)
+
+	code, ok := runCLI([]string{"export", faunPath})
+	assert.True(t, ok)
+	assert.Equal(t, exitSuccess, code)
+	assert.FileExists(t, filepath.Join(dir, "song.mid"))
+
+	code, _ = runCLI([]string{"convert", filepath.Join(dir, "song.mid"),
+		filepath.Join(dir, "copy.faun")})
+	assert.Equal(t, exitSuccess, code)
+	converted, err := loadSongFile(filepath.Join(dir, "copy.faun"), "")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(eventsOfType(converted, noteOnEvent)))
+
+	code, _ = runCLI([]string{"convert", faunPath, filepath.Join(dir, "song.txt")})
+	assert.Equal(t, exitError, code)
+	code, _ = runCLI([]string{"export"})
+	assert.Equal(t, exitError, code)
+}
+
+func TestRunCLIPolyphony(t *testing.T) {
+	dir := t.TempDir()
+	faunPath := filepath.Join(dir, "song.faun")
+	sng := newSong(nil)
+	sng.Tracks = nil
+	for i := 0; i < 16; i++ {
+		tr := newTrack(0, i)
+		tr.Events = []*trackEvent{{Type: noteOnEvent, FloatData: 60.5, ByteData1: 100, track: i}}
+		sng.Tracks = append(sng.Tracks, tr)
+	}
+	f, err := os.Create(faunPath)
+	assert.Nil(t, err)
+	assert.Nil(t, sng.write(f))
+	assert.Nil(t, f.Close())
+
+	code, _ := runCLI([]string{"export", faunPath})
+	assert.Equal(t, exitPolyphony, code)
+	assert.FileExists(t, filepath.Join(dir, "song.mid"))
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -234,13 +235,14 @@ func (d *dialog) getPath(
 	d.rejectEmpty = true
 }
 
-// return path targets for the given directory and filename extension
+// return path targets for the given directory and filename extension. the
+// extension matches as a prefix, so ".faun" also matches ".faunt".
 func pathTargets(dir, ext string) []*tabTarget {
 	ts := []*tabTarget{}
 	if f, err := os.Open(dir); err == nil {
 		if names, err := f.Readdirnames(maxDirNames); err == nil {
 			for _, name := range names {
-				if ext == "" || strings.HasSuffix(name, ext) {
+				if ext == "" || strings.HasPrefix(filepath.Ext(name), ext) {
 					ts = append(ts, &tabTarget{display: name, value: name})
 				}
 			}
@@ -6,6 +6,7 @@ import (
 	"encoding/csv"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
@@ -17,6 +18,11 @@ import (
 	"github.com/veandco/go-sdl2/sdl"
 )
 
+const (
+	mpeMasterChannel  = 0  // lower zone only
+	mpeInputBendRange = 48 // MPE default for member channels
+)
+
 var (
 	keymapPath = filepath.Join(configPath, "keymaps")
 
@@ -47,13 +53,38 @@ type keymap struct {
 	Items []*keyInfo
 
 	midimap     [128]float64
+	midiUnmap   [128]bool // true for midi keys that don't play notes
 	isPerc      bool
-	keyNotes    map[string]*trackEvent // map of keys to note on events
-	midiNotes   [128]*trackEvent       // map of midi notes to note on events
+	keyNotes    map[string]*trackEvent      // map of keys to note on events
+	midiNotes   map[midiNoteKey]*trackEvent // map of midi notes to note on events
+	mpeInputs   [numMidiChannels]mpeInput
 	activeNotes [24]bool
 	keySig      map[float64]*pitchSrc
 }
 
+// a held midi note, by source. devices can hold the same key at once.
+type midiNoteKey struct {
+	input   *midiInput
+	channel uint8
+	key     uint8
+}
+
+// state of an MPE member channel of midi input
+type mpeInput struct {
+	note  *trackEvent // note on event, if a note is held
+	pitch float64     // pitch of the held note without bend
+	bend  float64     // semitones
+}
+
+// return the state of the MPE member channel a midi message is on, or nil if
+// MPE input is off or the message is on the master channel
+func (k *keymap) mpeInput(msg []byte) *mpeInput {
+	if ch := msg[0] & 0xf; midiChannelBehavior == midiChannelMPE && ch != mpeMasterChannel {
+		return &k.mpeInputs[ch]
+	}
+	return nil
+}
+
 // return a copy of a keySig map
 func copyKeySig(in map[float64]*pitchSrc) map[float64]*pitchSrc {
 	out := make(map[float64]*pitchSrc)
@@ -67,9 +98,9 @@ func copyKeySig(in map[float64]*pitchSrc) map[float64]*pitchSrc {
 type keyInfo struct {
 	Key      string
 	IsMod    bool
-	Interval float64 // kept only for backwards compatibility, use semitones()
 	Name     string
 	PitchSrc *pitchSrc
+	Unmapped bool `json:",omitempty"` // only used for midi keys
 }
 
 // initialize a new key. does not report errors for bad src.
@@ -117,7 +148,12 @@ func (k *keymap) applyRecords(records [][]string) []string {
 	errs := []string{}
 	for _, rec := range records {
 		ok := false
-		if len(rec) == 3 {
+		if len(rec) == 3 && rec[2] == "x" && midiRegexp.MatchString(rec[0]) {
+			ki := newKeyInfo(rec[0], false, rec[1], newSemiPitch(0))
+			ki.Unmapped = true
+			k.Items = append(k.Items, ki)
+			ok = true
+		} else if len(rec) == 3 {
 			if pitch, err := parsePitch(rec[2], k); err == nil {
 				name := rec[1]
 				k.Items = append(k.Items,
@@ -163,11 +199,11 @@ func (k *keymap) genRecords() [][]string {
 			if ki.IsMod {
 				prefix = "*"
 			}
-			records = append(records, []string{
-				ki.Key,
-				ki.Name,
-				prefix + ki.PitchSrc.String(),
-			})
+			pitch := prefix + ki.PitchSrc.String()
+			if ki.Unmapped {
+				pitch = "x"
+			}
+			records = append(records, []string{ki.Key, ki.Name, pitch})
 		}
 	}
 	return records
@@ -220,10 +256,12 @@ func (k *keymap) duplicateOctave(interval *pitchSrc) {
 // generate the midi mappings from the existing keyInfo items
 func (k *keymap) setMidiPattern() {
 	firstMidi, lastMidi := -1, -1
+	k.midiUnmap = [128]bool{}
 	for _, ki := range k.Items {
 		if midiRegexp.MatchString(ki.Key) {
 			if i, err := strconv.ParseUint(ki.Key[1:], 10, 8); err == nil && i < 128 {
 				k.midimap[i] = ki.PitchSrc.semitones()
+				k.midiUnmap[i] = ki.Unmapped
 				if firstMidi == -1 || int(i) < firstMidi {
 					firstMidi = int(i)
 				}
@@ -249,19 +287,37 @@ func (k *keymap) repeatMidiPattern(firstIndex, lastIndex int) {
 				index += lastIndex - firstIndex
 			}
 			k.midimap[i] = k.midimap[index] + period*octave
+			k.midiUnmap[i] = k.midiUnmap[index]
 		}
 	}
 }
 
 // convert a scala .scl file into a keymap
 func keymapFromSclFile(path string) (*keymap, error) {
+	scale, err := readSclFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k := genScaleKeymap(strings.Replace(filepath.Base(path), ".scl", "", 1), scale)
+	k.duplicateOctave(scale[len(scale)-1])
+	k.setMidiPattern()
+	return k, nil
+}
+
+// read the pitches of a scala .scl file, including an initial 1/1
+func readSclFile(path string) ([]*pitchSrc, error) {
 	f, err := os.Open(joinTreePath(keymapPath, path))
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
+	return parseScl(f)
+}
+
+// parse the contents of a scala .scl file, including an initial 1/1
+func parseScl(r io.Reader) ([]*pitchSrc, error) {
 	var scale []*pitchSrc
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(r)
 	i := 0
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
@@ -283,10 +339,350 @@ func keymapFromSclFile(path string) (*keymap, error) {
 			i++
 		}
 	}
-	k := genScaleKeymap(strings.Replace(filepath.Base(path), ".scl", "", 1), scale)
+	if scale == nil || scale[len(scale)-1] == nil {
+		return nil, fmt.Errorf("invalid scale file")
+	}
+	return scale, scanner.Err()
+}
+
+// a scala .kbm keyboard mapping
+type kbmMapping struct {
+	size         int
+	firstNote    int
+	lastNote     int
+	middleNote   int
+	refNote      int
+	refFreq      float64
+	octaveDegree int
+	degrees      []int // -1 for unmapped keys
+}
+
+// read a scala .kbm file
+func readKbmFile(path string) (*kbmMapping, error) {
+	f, err := os.Open(joinTreePath(keymapPath, path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseKbm(f)
+}
+
+// parse the contents of a scala .kbm file
+func parseKbm(r io.Reader) (*kbmMapping, error) {
+	var err error
+	m := &kbmMapping{}
+	header := []*int{&m.size, &m.firstNote, &m.lastNote, &m.middleNote, &m.refNote,
+		nil, &m.octaveDegree}
+	scanner := bufio.NewScanner(r)
+	i := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "!") {
+			continue
+		}
+		// ignore anything after the first value on a line
+		line = strings.Fields(line)[0]
+		if i == 5 {
+			if m.refFreq, err = strconv.ParseFloat(line, 64); err != nil || m.refFreq <= 0 {
+				return nil, fmt.Errorf("invalid keyboard mapping file")
+			}
+		} else if i < len(header) {
+			if *header[i], err = strconv.Atoi(line); err != nil {
+				return nil, fmt.Errorf("invalid keyboard mapping file")
+			}
+		} else if len(m.degrees) < m.size {
+			if line == "x" {
+				m.degrees = append(m.degrees, -1)
+			} else if d, err := strconv.Atoi(line); err == nil && d >= 0 {
+				m.degrees = append(m.degrees, d)
+			} else {
+				return nil, fmt.Errorf("invalid keyboard mapping file")
+			}
+		}
+		i++
+	}
+	if i < len(header) || m.size < 0 {
+		return nil, fmt.Errorf("invalid keyboard mapping file")
+	}
+	// trailing unmapped keys may be left out
+	for len(m.degrees) < m.size {
+		m.degrees = append(m.degrees, -1)
+	}
+	return m, scanner.Err()
+}
+
+// return the interval from the middle note to a key and true, or false if the
+// key is unmapped
+func (m *kbmMapping) keyInterval(key int, scale []*pitchSrc) (*pitchSrc, bool) {
+	if key < m.firstNote || key > m.lastNote {
+		return nil, false
+	}
+	offset := key - m.middleNote
+	degree := offset
+	var periods int
+	if m.size > 0 {
+		periods = int(math.Floor(float64(offset) / float64(m.size)))
+		if degree = m.degrees[offset-periods*m.size]; degree < 0 {
+			return nil, false
+		}
+	}
+	octaveDegree := m.octaveDegree
+	if m.size == 0 || octaveDegree <= 0 {
+		octaveDegree = len(scale) - 1
+	}
+	return addPitchMultiple(scaleDegreePitch(scale, degree),
+		scaleDegreePitch(scale, octaveDegree), periods), true
+}
+
+// return the pitch of a scale degree, which may be outside the first period
+// of the scale
+func scaleDegreePitch(scale []*pitchSrc, degree int) *pitchSrc {
+	n := len(scale) - 1
+	periods := int(math.Floor(float64(degree) / float64(n)))
+	return addPitchMultiple(scale[degree-periods*n], scale[n], periods)
+}
+
+// return a + b*n, avoiding overflow of large ratios
+func addPitchMultiple(a, b *pitchSrc, n int) *pitchSrc {
+	if intAbs(n) > 8 {
+		return newSemiPitch(a.semitones() + b.semitones()*float64(n))
+	}
+	return a.add(b.multiply(n))
+}
+
+// convert a scala .scl file and .kbm file into a keymap, also returning the
+// absolute pitch of the middle note
+func keymapFromSclKbmFiles(sclPath, kbmPath string) (*keymap, float64, error) {
+	scale, err := readSclFile(sclPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(scale) < 2 {
+		return nil, 0, fmt.Errorf("invalid scale file")
+	}
+	m, err := readKbmFile(kbmPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	k, refPitch := keymapFromScaleKbm(
+		strings.Replace(filepath.Base(sclPath), ".scl", "", 1), scale, m)
+	return k, refPitch, nil
+}
+
+// generate a keymap for a scale with a keyboard mapping, also returning the
+// absolute pitch of the middle note
+func keymapFromScaleKbm(name string, scale []*pitchSrc, m *kbmMapping) (*keymap, float64) {
+	k := genScaleKeymap(name, scale)
 	k.duplicateOctave(scale[len(scale)-1])
+
+	// replace generated midi keys with one entry for every key
+	items := k.Items[:0]
+	for _, ki := range k.Items {
+		if !midiRegexp.MatchString(ki.Key) {
+			items = append(items, ki)
+		}
+	}
+	k.Items = items
+	for key := 0; key < len(k.midimap); key++ {
+		ps, ok := m.keyInterval(key, scale)
+		if !ok {
+			ki := newKeyInfo(fmt.Sprintf("m%d", key), false, "", newSemiPitch(0))
+			ki.Unmapped = true
+			k.Items = append(k.Items, ki)
+			continue
+		}
+		notation := notatePitchFromScale(ps, scale)
+		for _, ki := range k.Items {
+			if ki.Name == notation {
+				notation = ""
+				break
+			}
+		}
+		k.Items = append(k.Items, newKeyInfo(fmt.Sprintf("m%d", key), false, notation, ps))
+	}
 	k.setMidiPattern()
-	return k, err
+
+	// the reference note sounds at the reference frequency. if it's unmapped,
+	// the middle note does.
+	refPitch := 69 + 12*math.Log2(m.refFreq/440)
+	if ps, ok := m.keyInterval(m.refNote, scale); ok {
+		refPitch -= ps.semitones()
+	}
+	return k, refPitch
+}
+
+// return the degree notation used by genScaleKeymap for an interval in a scale,
+// or empty if the interval isn't in the scale
+func notatePitchFromScale(ps *pitchSrc, scale []*pitchSrc) string {
+	n := len(scale) - 1
+	class := ps.class(scale[n].semitones())
+	for i, ps2 := range scale[:n] {
+		if math.Abs(ps2.semitones()-class) < 0.001 {
+			return fmt.Sprintf("%d'", i+1)
+		}
+	}
+	return ""
+}
+
+// return the sorted, distinct non-accidental intervals of the keymap reduced
+// modulo period, starting with 1/1 and ending with period
+func (k *keymap) scalaScale(period *pitchSrc) []*pitchSrc {
+	scale := []*pitchSrc{newRatPitch(1, 1)}
+	for _, ki := range k.Items {
+		if ki.IsMod || ki.Unmapped {
+			continue
+		}
+		ps := ki.PitchSrc.modulo(period)
+		if math.Abs(ps.semitones()-period.semitones()) < 0.001 {
+			continue
+		}
+		duplicate := false
+		for i, ps2 := range scale {
+			if math.Abs(ps.semitones()-ps2.semitones()) < 0.001 {
+				// prefer ratios
+				if ps2.Ints[1] == 0 || ps2.IsEdx {
+					if ps.Ints[1] != 0 && !ps.IsEdx {
+						scale[i] = ps
+					}
+				}
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			scale = append(scale, ps)
+		}
+	}
+	sort.SliceStable(scale, func(i, j int) bool {
+		return scale[i].semitones() < scale[j].semitones()
+	})
+	return append(scale, period)
+}
+
+// return the text of a scala .scl file for a scale returned by scalaScale
+func formatScl(name string, scale []*pitchSrc) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "! %s.scl\n!\n%s\n %d\n!\n", name, name, len(scale)-1)
+	for _, ps := range scale[1:] {
+		if ps.Ints[1] != 0 && !ps.IsEdx {
+			fmt.Fprintf(&b, " %d/%d\n", ps.Ints[0], ps.Ints[1])
+		} else {
+			fmt.Fprintf(&b, " %f\n", ps.semitones()*100)
+		}
+	}
+	return b.String()
+}
+
+// return the text of a scala .kbm file which maps midi keys to the degrees of
+// a scale returned by scalaScale, as the keymap does. refPitch is the absolute
+// pitch of the keymap's root. keys that don't match a scale degree are left
+// unmapped.
+func (k *keymap) formatKbm(scale []*pitchSrc, refPitch float64) string {
+	n := len(scale) - 1
+	period := scale[n].semitones()
+	var degrees [128]int
+	var mapped [128]bool
+	for key, pitch := range k.midimap {
+		if k.midiUnmap[key] {
+			continue
+		}
+		periods := math.Floor(pitch/period + 0.0001)
+		rem := pitch - periods*period
+		for i, ps := range scale[:n] {
+			if math.Abs(ps.semitones()-rem) < 0.01 || (i == 0 && math.Abs(rem-period) < 0.01) {
+				degrees[key] = int(periods)*n + i
+				if i == 0 && math.Abs(rem-period) < 0.01 {
+					degrees[key] += n
+				}
+				mapped[key] = true
+				break
+			}
+		}
+	}
+
+	// use the key that plays the root as the middle note, if there is one
+	middle := 60
+	for d := 0; d < 128; d++ {
+		if key := 60 - d; key >= 0 && mapped[key] && degrees[key] == 0 {
+			middle = key
+			break
+		} else if key := 60 + d; key < 128 && mapped[key] && degrees[key] == 0 {
+			middle = key
+			break
+		}
+	}
+
+	// find the smallest repeating pattern; fall back to mapping every key
+	size, octaveDegree := 128, n
+	for s := 1; s < 128 && size == 128; s++ {
+		step, ok := -1, true
+		for key := 0; key+s < 128 && ok; key++ {
+			if mapped[key] != mapped[key+s] {
+				ok = false
+			} else if mapped[key] {
+				if step == -1 {
+					step = degrees[key+s] - degrees[key]
+				}
+				ok = step > 0 && degrees[key+s]-degrees[key] == step
+			}
+		}
+		if ok && step > 0 {
+			size, octaveDegree = s, step
+		}
+	}
+	if size == 128 {
+		middle = 0
+	}
+	entries := make([]string, size)
+	entryDegrees := make([]int, size)
+	offset := 0 // a whole number of periods, to keep degrees non-negative
+	for i := range entries {
+		key, d := middle+i, 0
+		if key >= 128 {
+			key -= size
+			d = octaveDegree
+		}
+		entries[i] = "x"
+		if mapped[key] {
+			entryDegrees[i] = degrees[key] + d
+			entries[i] = ""
+			for entryDegrees[i]+offset < 0 {
+				offset += n
+			}
+		}
+	}
+	for i := range entries {
+		if entries[i] == "" {
+			entries[i] = strconv.Itoa(entryDegrees[i] + offset)
+		}
+	}
+	for len(entries) > 0 && entries[len(entries)-1] == "x" {
+		entries = entries[:len(entries)-1]
+	}
+
+	// tune the first mapped key from the middle note up
+	refNote, refFreq := middle, 440*math.Pow(2, (refPitch-69)/12)
+	for i := 0; i < 128; i++ {
+		if key := (middle + i) % 128; mapped[key] {
+			refNote = key
+			refFreq = 440 * math.Pow(2, (refPitch+k.midimap[key]-69)/12)
+			break
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "! Size of map:\n%d\n", size)
+	fmt.Fprintf(&b, "! First MIDI note number to retune:\n0\n")
+	fmt.Fprintf(&b, "! Last MIDI note number to retune:\n127\n")
+	fmt.Fprintf(&b, "! Middle note where the first entry of the mapping is mapped to:\n%d\n", middle)
+	fmt.Fprintf(&b, "! Reference note for which frequency is given:\n%d\n", refNote)
+	fmt.Fprintf(&b, "! Frequency to tune the above note to:\n%f\n", refFreq)
+	fmt.Fprintf(&b, "! Scale degree to consider as formal octave:\n%d\n", octaveDegree)
+	fmt.Fprintf(&b, "! Mapping:\n")
+	for _, e := range entries {
+		fmt.Fprintln(&b, e)
+	}
+	return b.String()
 }
 
 // convert a scala pitch string into a pitch struct
@@ -530,16 +926,29 @@ func (k *keymap) keyboardEvent(e *sdl.KeyboardEvent, pe *patternEditor, p *playe
 	}
 }
 
-// respond to midi input events
-func (k *keymap) midiEvent(msg []byte, pe *patternEditor, p *player, keyjazz bool) {
+// respond to midi input events from an input, which may be nil
+func (k *keymap) midiEvent(msg []byte, pe *patternEditor, p *player, keyjazz bool,
+	input *midiInput) {
+	drums := input != nil && input.role == inputPercussion
+	noteKey := midiNoteKey{input, msg[0] & 0xf, msg[1]}
 	var octaveOffset byte
 	if midiChannelBehavior == midiChannelOctaves {
 		octaveOffset = msg[0] & 0xf
 	}
+	tick, playing := p.playPos()
+	record := pe.recordMode && playing && !keyjazz
+	mpe := k.mpeInput(msg)
 	if msg[0]&0xf0 == 0x90 && msg[2] > 0 { // note on
 		var te *trackEvent
-		if sdl.GetModState()&sdl.KMOD_SHIFT == 0 {
+		if !drums && sdl.GetModState()&sdl.KMOD_SHIFT == 0 {
+			if k.midiUnmap[msg[1]] {
+				return
+			}
 			pitch := k.adjustPerKeySig(k.midimap[msg[1]]) + pe.refPitch + float64(octaveOffset)*12
+			if mpe != nil {
+				mpe.pitch = pitch
+				pitch += mpe.bend
+			}
 			te = newTrackEvent(&trackEvent{
 				Type:      noteOnEvent,
 				FloatData: pitch,
@@ -552,28 +961,177 @@ func (k *keymap) midiEvent(msg []byte, pe *patternEditor, p *player, keyjazz boo
 				ByteData2: msg[2],
 			}, k)
 		}
-		k.processKeymapNoteOn(te, pe, p, keyjazz)
-		k.midiNotes[msg[1]] = te
+		k.processKeymapNoteOn(te, pe, p, keyjazz || record)
+		if mpe != nil {
+			mpe.note = te
+		} else {
+			if k.midiNotes == nil {
+				k.midiNotes = make(map[midiNoteKey]*trackEvent)
+			}
+			k.midiNotes[noteKey] = te
+		}
+		if record {
+			pe.recordEvent(te, tick)
+		}
 	} else if msg[0]&0xf0 == 0x80 || (msg[0]&0xf0 == 0x90 && msg[2] == 0) { // note off
-		if te := k.midiNotes[msg[1]]; te != nil {
+		te := k.midiNotes[noteKey]
+		if mpe != nil {
+			te = mpe.note
+		}
+		if te != nil {
 			p.signal <- playerSignal{typ: signalEvent, event: &trackEvent{
 				Type:  noteOffEvent,
 				track: te.track,
 			}}
-			k.midiNotes[msg[1]] = nil
+			if mpe != nil {
+				mpe.note = nil
+			} else {
+				delete(k.midiNotes, noteKey)
+			}
 			k.setActiveNote(te.chordIndex, false)
+			if record {
+				pe.recordEvent(newTrackEvent(&trackEvent{
+					Type:  noteOffEvent,
+					track: te.track,
+				}, nil), tick)
+			}
+		}
+	}
+}
+
+// respond to midi input controller, pitch bend, and pressure events. these
+// are played and recorded when recording or in keyjazz mode, and otherwise
+// ignored.
+func (k *keymap) midiControlEvent(msg []byte, pe *patternEditor, p *player, keyjazz bool,
+	input *midiInput) {
+	tick, playing := p.playPos()
+	record := pe.recordMode && playing && !keyjazz
+	if !record && !keyjazz {
+		return
+	}
+	for _, te := range k.controlEvents(msg, pe, input) {
+		p.signal <- playerSignal{typ: signalEvent, event: te}
+		if record {
+			pe.recordEvent(te, tick)
+		}
+	}
+}
+
+// return the track events for a midi controller, pitch bend, or pressure
+// message from an input, on the tracks of the notes they affect
+func (k *keymap) controlEvents(msg []byte, pe *patternEditor, input *midiInput) []*trackEvent {
+	if mpe := k.mpeInput(msg); mpe != nil {
+		return k.mpeControlEvents(msg, mpe)
+	}
+	var tes []*trackEvent
+	switch msg[0] & 0xf0 {
+	case 0xa0: // poly pressure
+		if te := k.midiNotes[midiNoteKey{input, msg[0] & 0xf, msg[1]}]; te != nil {
+			tes = append(tes, newTrackEvent(&trackEvent{
+				Type:      keyPressureEvent,
+				ByteData1: msg[2],
+				track:     te.track,
+			}, k))
+		}
+	case 0xb0: // controller
+		tes = append(tes, newTrackEvent(&trackEvent{
+			Type:      controllerEvent,
+			ByteData1: msg[1],
+			ByteData2: msg[2],
+			track:     k.controlTrack(pe),
+		}, k))
+	case 0xd0: // channel pressure
+		tes = append(tes, newTrackEvent(&trackEvent{
+			Type:      channelPressureEvent,
+			ByteData1: msg[1],
+			track:     k.controlTrack(pe),
+		}, k))
+	case 0xe0: // pitch bend, relative to each held note
+		bend := midiBendValue(msg) * float64(inputBendRange)
+		for _, te := range k.heldMidiNotes() {
+			if te.Type == noteOnEvent {
+				tes = append(tes, newTrackEvent(&trackEvent{
+					Type:      pitchBendEvent,
+					FloatData: te.FloatData + bend,
+					track:     te.track,
+				}, k))
+			}
 		}
 	}
+	return tes
+}
+
+// return the track events for a message on an MPE member channel, on the
+// track of the channel's note
+func (k *keymap) mpeControlEvents(msg []byte, mpe *mpeInput) []*trackEvent {
+	if msg[0]&0xf0 == 0xe0 {
+		mpe.bend = midiBendValue(msg) * mpeInputBendRange
+	}
+	te := mpe.note
+	if te == nil {
+		return nil
+	}
+	var te2 *trackEvent
+	switch msg[0] & 0xf0 {
+	case 0xa0: // poly pressure
+		te2 = &trackEvent{Type: keyPressureEvent, ByteData1: msg[2]}
+	case 0xb0: // controller, usually timbre
+		te2 = &trackEvent{Type: controllerEvent, ByteData1: msg[1], ByteData2: msg[2]}
+	case 0xd0: // channel pressure
+		te2 = &trackEvent{Type: keyPressureEvent, ByteData1: msg[1]}
+	case 0xe0: // pitch bend
+		if te.Type != noteOnEvent {
+			return nil
+		}
+		te2 = &trackEvent{Type: pitchBendEvent, FloatData: mpe.pitch + mpe.bend}
+	}
+	te2.track = te.track
+	return []*trackEvent{newTrackEvent(te2, k)}
+}
+
+// return a pitch bend message's value, range -1 to 1
+func midiBendValue(msg []byte) float64 {
+	return float64(int(msg[2])<<7|int(msg[1])-0x2000) / 0x2000
+}
+
+// return the note on events of held midi notes
+func (k *keymap) heldMidiNotes() []*trackEvent {
+	var tes []*trackEvent
+	for _, te := range k.midiNotes {
+		tes = append(tes, te)
+	}
+	for _, mpe := range k.mpeInputs {
+		if mpe.note != nil {
+			tes = append(tes, mpe.note)
+		}
+	}
+	return tes
+}
+
+// return the track that channel-wide input events go on: the first track
+// with a held midi note, or the first selected track
+func (k *keymap) controlTrack(pe *patternEditor) int {
+	track, _, _, _ := pe.getSelection()
+	found := false
+	for _, te := range k.heldMidiNotes() {
+		if !found || te.track < track {
+			track, found = te.track, true
+		}
+	}
+	return track
 }
 
 // convert a key string to an absolute pitch
 func (k *keymap) pitchFromString(s string, refPitch float64) (float64, bool) {
 	if ki := k.getByKey(s); ki != nil {
+		if ki.Unmapped {
+			return 0, false
+		}
 		pitch := k.adjustPerKeySig(ki.PitchSrc.semitones()) + refPitch
 		pitch = math.Max(minPitch, math.Min(maxPitch, pitch))
 		return pitch, true
 	} else if midiRegexp.MatchString(s) {
-		if i, _ := strconv.ParseUint(s[1:], 10, 8); int(i) < len(k.midimap) {
+		if i, _ := strconv.ParseUint(s[1:], 10, 8); int(i) < len(k.midimap) && !k.midiUnmap[i] {
 			pitch := k.adjustPerKeySig(k.midimap[i]) + refPitch
 			pitch = math.Max(minPitch, math.Min(maxPitch, pitch))
 			return pitch, true
@@ -611,8 +1169,15 @@ func (k *keymap) processKeymapNoteOn(te *trackEvent, pe *patternEditor, p *playe
 		}
 	}
 	for i, v := range k.midiNotes {
-		if v != nil && v.track == te.track {
-			k.midiNotes[i] = nil
+		if v.track == te.track {
+			delete(k.midiNotes, i)
+			k.setActiveNote(v.chordIndex, false)
+			break
+		}
+	}
+	for i, mpe := range k.mpeInputs {
+		if v := mpe.note; v != nil && v.track == te.track {
+			k.mpeInputs[i].note = nil
 			k.setActiveNote(v.chordIndex, false)
 			break
 		}
@@ -701,7 +1266,7 @@ func (k *keymap) notatePitchWithMods(f float64, auto, octave bool, mods ...*keyI
 	target := posMod(f, 12)
 	for _, ki := range k.Items {
 		diff := math.Abs(ki.PitchSrc.class(12) - target)
-		if !ki.IsMod && (diff < 0.01 || diff > 11.99) {
+		if !ki.IsMod && !ki.Unmapped && (diff < 0.01 || diff > 11.99) {
 			var base string
 			if auto {
 				base = ki.PitchSrc.String()
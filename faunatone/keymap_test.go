@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testKbm = `! 7 white keys of a 12-note scale, A=432
+12
+0
+127
+60
+69
+432.0
+12
+! mapping
+0
+x
+2
+x
+4
+5
+x
+7
+x
+9
+x
+`
+
+func TestKbm(t *testing.T) {
+	m, err := parseKbm(bytes.NewBufferString(testKbm))
+	assert.Nil(t, err)
+	assert.Equal(t, 12, m.size)
+	assert.Equal(t, 432.0, m.refFreq)
+	assert.Equal(t, []int{0, -1, 2, -1, 4, 5, -1, 7, -1, 9, -1, -1}, m.degrees)
+
+	scale := make([]*pitchSrc, 13)
+	for i := range scale {
+		scale[i] = newEdxPitch(12, i, 12)
+	}
+	k, root := keymapFromScaleKbm("test", scale, m)
+	assert.InDelta(t, 60+12*math.Log2(432.0/440), root, 0.0001)
+	assert.Equal(t, 0.0, k.midimap[60])
+	assert.Equal(t, 9.0, k.midimap[69])
+	assert.Equal(t, -3.0, k.midimap[57])
+	assert.Equal(t, 24.0, k.midimap[84])
+	assert.True(t, k.midiUnmap[61])
+	assert.True(t, k.midiUnmap[71])
+	assert.False(t, k.midiUnmap[72])
+	_, ok := k.pitchFromString("m61", 60)
+	assert.False(t, ok)
+	pitch, ok := k.pitchFromString("m62", 60)
+	assert.True(t, ok)
+	assert.Equal(t, 62.0, pitch)
+
+	// unmapped keys survive a round trip through CSV
+	k2 := newEmptyKeymap("test")
+	assert.Empty(t, k2.applyRecords(k.genRecords()))
+	k2.setMidiPattern()
+	assert.Equal(t, k.midiUnmap, k2.midiUnmap)
+	assert.Equal(t, k.midimap, k2.midimap)
+
+	_, err = parseKbm(bytes.NewBufferString("12\n0\n127\n"))
+	assert.NotNil(t, err)
+}
+
+func TestScalaExport(t *testing.T) {
+	k, err := genRank2Keymap(newRatPitch(2, 1), newRatPitch(3, 2), 7)
+	assert.Nil(t, err)
+	k.Items = append(k.Items, newKeyInfo("=", true, "#", newRatPitch(2187, 2048)))
+	scale := k.scalaScale(newRatPitch(2, 1))
+	assert.Equal(t, 8, len(scale))
+	text := formatScl("pyth", scale)
+	assert.Contains(t, text, " 9/8\n")
+	assert.Contains(t, text, " 2/1\n")
+	scale2, err := parseScl(bytes.NewBufferString(text))
+	assert.Nil(t, err)
+	assert.Equal(t, len(scale), len(scale2))
+	for i := range scale {
+		assert.InDelta(t, scale[i].semitones(), scale2[i].semitones(), 0.0001)
+	}
+
+	// keyboard mapping round trip, including unmapped keys
+	m, err := parseKbm(bytes.NewBufferString(testKbm))
+	assert.Nil(t, err)
+	edo := make([]*pitchSrc, 13)
+	for i := range edo {
+		edo[i] = newEdxPitch(12, i, 12)
+	}
+	k, root := keymapFromScaleKbm("test", edo, m)
+	scale = k.scalaScale(newRatPitch(2, 1))
+	m2, err := parseKbm(bytes.NewBufferString(k.formatKbm(scale, root)))
+	assert.Nil(t, err)
+	assert.Equal(t, 12, m2.size)
+	k2, root2 := keymapFromScaleKbm("test", scale, m2)
+	assert.InDelta(t, root, root2, 0.0001)
+	assert.Equal(t, k.midiUnmap, k2.midiUnmap)
+	for i := range k.midimap {
+		if !k.midiUnmap[i] {
+			assert.InDelta(t, k.midimap[i], k2.midimap[i], 0.0001)
+		}
+	}
+}
+
+func TestMPEControlEvents(t *testing.T) {
+	defer func(b int) { midiChannelBehavior = b }(midiChannelBehavior)
+	midiChannelBehavior = midiChannelMPE
+	k := newEmptyKeymap("test")
+	pe := &patternEditor{song: newSong(nil)}
+
+	// bend before the note on a member channel, as MPE controllers send it
+	assert.Nil(t, k.controlEvents([]byte{0xe2, 0x00, 0x48}, pe, nil))
+	mpe := k.mpeInput([]byte{0xe2})
+	assert.InDelta(t, 6, mpe.bend, 1e-9)
+	mpe.note, mpe.pitch = &trackEvent{Type: noteOnEvent, FloatData: 66, track: 3}, 60
+
+	tes := k.controlEvents([]byte{0xe2, 0x00, 0x50}, pe, nil) // glide up an octave
+	if assert.Len(t, tes, 1) {
+		assert.Equal(t, pitchBendEvent, tes[0].Type)
+		assert.Equal(t, 3, tes[0].track)
+		assert.InDelta(t, 72, tes[0].FloatData, 1e-9)
+	}
+	tes = k.controlEvents([]byte{0xd2, 0x40}, pe, nil)
+	if assert.Len(t, tes, 1) {
+		assert.Equal(t, []interface{}{keyPressureEvent, uint8(0x40), 3},
+			[]interface{}{tes[0].Type, tes[0].ByteData1, tes[0].track})
+	}
+	tes = k.controlEvents([]byte{0xb2, ccTimbre, 0x20}, pe, nil)
+	if assert.Len(t, tes, 1) {
+		assert.Equal(t, []interface{}{controllerEvent, uint8(ccTimbre), uint8(0x20), 3},
+			[]interface{}{tes[0].Type, tes[0].ByteData1, tes[0].ByteData2, tes[0].track})
+	}
+
+	// other member channels have no note, and the master channel isn't per-note
+	assert.Nil(t, k.controlEvents([]byte{0xd3, 0x40}, pe, nil))
+	assert.Nil(t, k.mpeInput([]byte{0xd0, 0x40}))
+}
+
+func TestMidiNotesPerInput(t *testing.T) {
+	k := newEmptyKeymap("test")
+	pe := &patternEditor{song: newSong(nil), cursorTrackDrag: 1}
+	p := &player{signal: make(chan playerSignal, 8)}
+	pad1 := &midiInput{role: inputPercussion}
+	pad2 := &midiInput{role: inputPercussion}
+
+	// both devices hold the same key on the same channel
+	k.midiEvent([]byte{0x90, 60, 100}, pe, p, true, pad1)
+	k.midiEvent([]byte{0x90, 60, 100}, pe, p, true, pad2)
+	assert.Len(t, k.heldMidiNotes(), 2)
+
+	// poly pressure and note off only reach the device's own note
+	tes := k.controlEvents([]byte{0xa0, 60, 0x40}, pe, pad2)
+	if assert.Len(t, tes, 1) {
+		assert.Equal(t, 1, tes[0].track)
+	}
+	k.midiEvent([]byte{0x80, 60, 0}, pe, p, true, pad1)
+	k.midiEvent([]byte{0x80, 60, 0}, pe, p, true, pad1)
+	assert.Len(t, k.heldMidiNotes(), 1)
+	k.midiEvent([]byte{0x90, 60, 0}, pe, p, true, pad2)
+	assert.Empty(t, k.heldMidiNotes())
+
+	offTracks := []int{}
+	for len(p.signal) > 0 {
+		if sig := <-p.signal; sig.event.Type == noteOffEvent {
+			offTracks = append(offTracks, sig.event.track)
+		}
+	}
+	assert.Equal(t, []int{0, 1}, offTracks)
+}
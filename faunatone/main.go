@@ -14,8 +14,6 @@ import (
 
 	"github.com/veandco/go-sdl2/sdl"
 	"github.com/veandco/go-sdl2/ttf"
-	"gitlab.com/gomidi/midi"
-	"gitlab.com/gomidi/midi/reader"
 	"gitlab.com/gomidi/midi/writer"
 	driver "gitlab.com/gomidi/rtmididrv"
 )
@@ -35,6 +33,7 @@ const (
 const (
 	midiChannelIgnore int = iota
 	midiChannelOctaves
+	midiChannelMPE
 )
 
 var midiChannelBehavior int
@@ -44,6 +43,10 @@ var embedFS embed.FS
 
 var (
 	bendSemitones     = 24
+	inputBendRange    = 2
+	recordThinning    = 16
+	exportMuteSolo    = true
+	chaseHeldNotes    = true
 	colorBeatArray    = make([]uint8, 4)
 	colorBg1Array     = make([]uint8, 4)
 	colorBg2Array     = make([]uint8, 4)
@@ -69,10 +72,19 @@ func must(err error) {
 }
 
 func main() {
+	if code, ok := runCLI(os.Args[1:]); ok {
+		os.Exit(code)
+	}
+
 	dia := &dialog{}
 
 	settings := loadSettings(func(s string) { println(s) })
 	bendSemitones = settings.PitchBendSemitones
+	inputBendRange = settings.MidiInputBendRange
+	recordThinning = settings.RecordThinning
+	exportMuteSolo = settings.ExportMuteSolo
+	chaseHeldNotes = settings.ChaseHeldNotes
+	synthOptions = settings.synthParams()
 	setColorArray(colorBeatArray, settings.ColorBeat)
 	setColorArray(colorBg1Array, settings.ColorBg1)
 	setColorArray(colorBg2Array, settings.ColorBg2)
@@ -85,6 +97,8 @@ func main() {
 		midiChannelBehavior = midiChannelIgnore
 	case "octaves":
 		midiChannelBehavior = midiChannelOctaves
+	case "mpe":
+		midiChannelBehavior = midiChannelMPE
 	default:
 		dia.message(fmt.Sprintf("Invalid MidiInputChannels setting: %q", settings.MidiInputChannels))
 	}
@@ -94,50 +108,32 @@ func main() {
 	must(err)
 	defer drv.Close()
 
-	midiIn := make(chan midi.Message, 100)
-	if n := settings.MidiInPortNumber; n >= 0 {
-		ins, err := drv.Ins()
-		must(err)
-		if n < len(ins) {
-			in := ins[n]
-			must(in.Open())
-			defer in.Close()
-			rd := reader.New(reader.NoLogger(),
-				reader.Each(func(pos *reader.Position, msg midi.Message) {
-					select {
-					case midiIn <- msg:
-					default:
-					}
-				}),
-			)
-			err = rd.ListenTo(in)
-			must(err)
+	ports := newMIDIPorts(drv, loadMIDIInputs(settings, func(s string) { println(s) }),
+		parsePortSpecs(settings.MidiOutPortNumber))
+	defer ports.close()
+	for i, mi := range ports.ins {
+		if mi.spec.isNone() {
+			continue
+		}
+		if err := ports.selectInput(i, mi.spec); err != nil {
+			dia.message(err.Error() + ".")
+		}
+	}
+	for i, pw := range ports.outs {
+		if err := ports.selectOutput(i, pw.spec); err == nil {
+			sendSystemOn(pw, 0)
 		} else {
-			dia.message(fmt.Sprintf("MIDI input port index %d out of range [%d, %d].",
-				n, 0, len(ins)))
+			dia.message(err.Error() + ".")
 		}
 	}
+	ports.lastScan = time.Now()
 
-	var wrs []writer.ChannelWriter
-	outPorts, err := settings.parsedMidiOutPortNumbers()
-	if err != nil {
-		dia.message("Could not parse MidiOutPortNumber setting.")
-	}
-	for _, port := range outPorts {
-		if port >= 0 {
-			outs, err := drv.Outs()
-			must(err)
-			if port < len(outs) {
-				out := outs[port]
-				must(out.Open())
-				defer out.Close()
-				wr := writer.New(out)
-				sendSystemOn(wr, 0)
-				wrs = append(wrs, wr)
-			} else {
-				dia.message(fmt.Sprintf("MIDI output port index %d out of range [%d, %d].",
-					port, 0, len(outs)))
-			}
+	wrs := ports.writers()
+	for _, addr := range settings.oscOutputAddresses() {
+		if wr, err := dialOSC(addr); err == nil {
+			wrs = append(wrs, wr)
+		} else {
+			dia.message(err.Error())
 		}
 	}
 	if wrs == nil {
@@ -192,6 +188,20 @@ func main() {
 	}
 	pl := newPlayer(sng, wrs, true)
 	pl.redrawChan = redrawChan
+	go func() {
+		for msg := range ports.clock {
+			pl.clockMessage(msg)
+		}
+	}()
+	if indices, err := settings.midiClockOutputs(); err == nil {
+		for _, i := range indices {
+			if i < len(ports.outs) {
+				pl.outputs[i].clock = true
+			}
+		}
+	} else {
+		dia.message(err.Error() + ".")
+	}
 	go pl.run()
 	defer pl.cleanup()
 	sng.Keymap, err = newKeymap(settings.DefaultKeymap)
@@ -217,6 +227,7 @@ func main() {
 
 	running := true
 	keyjazz := false
+	externalClock := false
 
 	mb := &menuBar{
 		menus: []*menu{
@@ -225,8 +236,12 @@ func main() {
 				items: []*menuItem{
 					{label: "New", action: func() { dialogNew(dia, sng, patedit, pl) }},
 					{label: "Open...", action: func() { dialogOpen(dia, sng, patedit, pl) }},
+					{label: "Import MIDI...", action: func() { dialogImportMidi(dia, sng, patedit, pl) }},
 					{label: "Save as...", action: func() { dialogSaveAs(dia, sng) }},
 					{label: "Export MIDI...", action: func() { dialogExportMidi(dia, sng, pl) }},
+					{label: "Export multi-track MIDI...", action: func() { dialogExportMultitrackMidi(dia, sng, pl) }},
+					{label: "Export MIDI 2.0 clip...", action: func() { dialogExportMidiClip(dia, sng, pl) }},
+					{label: "Export audio...", action: func() { dialogExportAudio(dia, sng, pl) }},
 					{label: "Quit", action: func() { running = false }},
 				},
 			},
@@ -244,11 +259,20 @@ func main() {
 						_, _, minTick, _ := patedit.getSelection()
 						pl.signal <- playerSignal{typ: signalStart, tick: minTick}
 					}},
+					{label: "Loop selection", action: func() {
+						_, _, minTick, maxTick := patedit.getSelection()
+						pl.signal <- playerSignal{typ: signalLoop, tick: minTick,
+							end: maxTick + ticksPerBeat/int64(patedit.division)}
+					}},
 					{label: "Stop", action: func() {
 						pl.stop(false)
 						sng.Keymap.clearActiveNotes()
 						percKeymap.clearActiveNotes()
 					}},
+					{label: "Toggle external clock", action: func() {
+						externalClock = !externalClock
+						pl.signal <- playerSignal{typ: signalToggleExternalClock}
+					}},
 				},
 			},
 			{
@@ -371,6 +395,12 @@ func main() {
 					{label: "Toggle song follow", action: func() {
 						patedit.followSong = !patedit.followSong
 					}},
+					{label: "Toggle record", action: func() {
+						patedit.recordMode = !patedit.recordMode
+					}},
+					{label: "Toggle record quantization", action: func() {
+						patedit.recordQuantize = !patedit.recordQuantize
+					}},
 				},
 			},
 			{
@@ -383,6 +413,18 @@ func main() {
 					{label: "Import Scala scale...", action: func() {
 						dialogImportScl(dia, sng, patedit)
 					}},
+					{label: "Import Scala scale with mapping...", action: func() {
+						dialogImportSclKbm(dia, sng, patedit)
+					}},
+					{label: "Export Scala scale...", action: func() {
+						dialogExportScl(dia, sng, patedit)
+					}},
+					{label: "Import AnaMark tuning...", action: func() {
+						dialogImportTun(dia, sng, patedit)
+					}},
+					{label: "Export AnaMark tuning...", action: func() {
+						dialogExportTun(dia, sng, patedit)
+					}},
 					{label: "Remap key...", action: func() { dialogRemapKey(dia, sng, patedit) }},
 					{label: "Generate equal division...", action: func() {
 						dialogMakeEdoKeymap(dia, sng, patedit)
@@ -411,6 +453,14 @@ func main() {
 						repeat: true},
 					{label: "Move right", action: func() { patedit.shiftTracks(1) },
 						repeat: true},
+					{label: "Toggle mute", action: func() {
+						patedit.toggleMute()
+						pl.signal <- playerSignal{typ: signalMuteChanged}
+					}},
+					{label: "Toggle solo", action: func() {
+						patedit.toggleSolo()
+						pl.signal <- playerSignal{typ: signalMuteChanged}
+					}},
 				},
 			},
 			{
@@ -422,6 +472,12 @@ func main() {
 					{label: "Display available outputs", action: func() {
 						dialogMidiOutputs(dia, drv)
 					}},
+					{label: "Select input...", action: func() {
+						dialogSelectMidiInput(dia, ports)
+					}},
+					{label: "Select output...", action: func() {
+						dialogSelectMidiOutput(dia, ports, pl)
+					}},
 					{label: "Send pitch bend sensitivity RPN", action: func() {
 						pl.signal <- playerSignal{typ: signalSendPitchRPN}
 					}},
@@ -447,20 +503,24 @@ func main() {
 		func() string { return fmt.Sprintf("Keymap: %s", sng.Keymap.Name) },
 		func() string { return conditionalString(patedit.followSong, "Follow", "") },
 		func() string { return conditionalString(keyjazz, "Keyjazz", "") },
+		func() string { return conditionalString(externalClock, "External clock", "") },
+		func() string {
+			_, playing := pl.playPos()
+			return conditionalString(playing, pl.timing.String(), "")
+		},
+		func() string {
+			return conditionalString(patedit.recordMode,
+				conditionalString(patedit.recordQuantize, "Record (quantized)", "Record"), "")
+		},
 	)
 
 	// attempt to load save file specified by first CLI arg
 	if len(os.Args) > 1 {
 		path := os.Args[1]
-		if f, err := os.Open(path); err == nil {
-			if err := sng.read(f); err == nil {
-				statusf("Loaded %s.", path)
-				saveAutofill = filepath.Base(path)
-				exportAutofill = replaceSuffix(saveAutofill, fileExt, ".mid")
-			} else {
-				dia.message(err.Error())
-			}
-			f.Close()
+		if err := sng.readFile(path); err == nil {
+			statusf("Loaded %s.", path)
+			saveAutofill = filepath.Base(path)
+			exportAutofill = replaceSuffix(saveAutofill, filepath.Ext(path), ".mid")
 		} else {
 			dia.message(err.Error())
 		}
@@ -515,14 +575,24 @@ func main() {
 	midiEvents:
 		for {
 			select {
-			case msg := <-midiIn:
+			case im := <-ports.messages:
+				msg, ok := im.input.filter(im.msg)
+				if !ok {
+					break
+				}
 				if dia.shown {
-					dia.midiEvent(msg.Raw())
-					redrawChan <- true
+					if im.input.role != inputControl {
+						dia.midiEvent(msg)
+						redrawChan <- true
+					}
+				} else if im.input.role == inputControl {
+					mb.midiEvent(msg)
 				} else {
-					switch msg.Raw()[0] & 0xf0 {
+					switch msg[0] & 0xf0 {
 					case 0x80, 0x90: // note off, note on
-						sng.Keymap.midiEvent(msg.Raw(), patedit, pl, keyjazz)
+						sng.Keymap.midiEvent(msg, patedit, pl, keyjazz, im.input)
+					case 0xa0, 0xb0, 0xd0, 0xe0: // pressure, controller, bend
+						sng.Keymap.midiControlEvent(msg, patedit, pl, keyjazz, im.input)
 					}
 				}
 			default:
@@ -530,6 +600,20 @@ func main() {
 			}
 		}
 
+		// reconnect MIDI devices that were plugged back in
+		names, err := ports.rescan(time.Now())
+		if len(names) > 0 {
+			statusf("Connected %s.", strings.Join(names, ", "))
+			pl.signal <- playerSignal{typ: signalSendSystemOn}
+			pl.signal <- playerSignal{typ: signalSendPitchRPN}
+		}
+		if err != nil {
+			statusf(err.Error())
+		}
+
+		// write any recording once playback stops
+		patedit.updateRecording(pl.playPos())
+
 		// hack to prevent Alt+<letter> from typing <letter> into dialog
 		dia.accept = dia.shown
 
@@ -884,6 +968,85 @@ func dialogImportScl(d *dialog, sng *song, pe *patternEditor) {
 	})
 }
 
+// set d to an input dialog chain
+func dialogImportSclKbm(d *dialog, sng *song, pe *patternEditor) {
+	d.getPath("Import Scala scale:", keymapPath, ".scl", true, func(scl string) {
+		scl = addSuffixIfMissing(scl, ".scl")
+		d.getPath("Keyboard mapping:", keymapPath, ".kbm", true, func(kbm string) {
+			kbm = addSuffixIfMissing(kbm, ".kbm")
+			if k, root, err := keymapFromSclKbmFiles(scl, kbm); err == nil {
+				sng.Keymap = k
+				sng.renameNotes()
+				pe.modifyRefPitch(root - pe.refPitch)
+			} else {
+				d.message(err.Error())
+			}
+		})
+	})
+}
+
+// set d to an input dialog chain
+func dialogExportScl(d *dialog, sng *song, pe *patternEditor) {
+	d.getInterval("Period:", sng.Keymap, func(period *pitchSrc) {
+		if period.semitones() <= 0 {
+			d.message("Period must be positive.")
+			return
+		}
+		d.getPath("Export Scala scale as:", keymapPath, ".scl", false, func(s string) {
+			s = addSuffixIfMissing(s, ".scl")
+			scale := sng.Keymap.scalaScale(period)
+			text := formatScl(strings.TrimSuffix(s, ".scl"), scale)
+			if err := os.WriteFile(joinTreePath(keymapPath, s), []byte(text), 0644); err != nil {
+				d.message(err.Error())
+				return
+			}
+			statusf("Wrote %s.", s)
+			*d = *newDialog("Also export keyboard mapping? (y/n)", 0, func(string) {
+				kbm := replaceSuffix(s, ".scl", ".kbm")
+				text := sng.Keymap.formatKbm(scale, pe.refPitch)
+				if err := os.WriteFile(joinTreePath(keymapPath, kbm), []byte(text), 0644); err != nil {
+					d.message(err.Error())
+				} else {
+					statusf("Wrote %s and %s.", s, kbm)
+				}
+			})
+			d.mode = yesNoInput
+		})
+		d.input = sng.Keymap.Name + ".scl"
+		d.updateCurTargets()
+	})
+	d.input = "2/1"
+}
+
+// set d to an input dialog
+func dialogImportTun(d *dialog, sng *song, pe *patternEditor) {
+	d.getPath("Import AnaMark tuning:", keymapPath, ".tun", true, func(s string) {
+		s = addSuffixIfMissing(s, ".tun")
+		if k, root, err := keymapFromTunFile(s); err == nil {
+			sng.Keymap = k
+			sng.renameNotes()
+			pe.modifyRefPitch(root - pe.refPitch)
+		} else {
+			d.message(err.Error())
+		}
+	})
+}
+
+// set d to an input dialog
+func dialogExportTun(d *dialog, sng *song, pe *patternEditor) {
+	d.getPath("Export AnaMark tuning as:", keymapPath, ".tun", false, func(s string) {
+		s = addSuffixIfMissing(s, ".tun")
+		text := sng.Keymap.formatTun(strings.TrimSuffix(s, ".tun"), pe.refPitch)
+		if err := os.WriteFile(joinTreePath(keymapPath, s), []byte(text), 0644); err != nil {
+			d.message(err.Error())
+		} else {
+			statusf("Wrote %s.", s)
+		}
+	})
+	d.input = sng.Keymap.Name + ".tun"
+	d.updateCurTargets()
+}
+
 // set d to an input dialog chain
 func dialogMakeEdoKeymap(d *dialog, sng *song, pe *patternEditor) {
 	d.getInterval("Interval to divide:", sng.Keymap, func(ps *pitchSrc) {
@@ -946,13 +1109,12 @@ func dialogNew(d *dialog, sng *song, pe *patternEditor, p *player) {
 
 // set d to an input dialog
 func dialogOpen(d *dialog, sng *song, pe *patternEditor, p *player) {
-	d.getPath("Load song:", savesPath, ".faun", true, func(s string) {
-		s = addSuffixIfMissing(s, fileExt)
-		if f, err := os.Open(joinTreePath(savesPath, s)); err == nil {
-			defer f.Close()
+	d.getPath("Load song:", savesPath, fileExt, true, func(s string) {
+		s = addSongSuffixIfMissing(s)
+		if _, err := os.Stat(joinTreePath(savesPath, s)); err == nil {
 			p.stop(true)
 			p.signal <- playerSignal{typ: signalResetChannels}
-			if err := sng.read(f); err == nil {
+			if err := sng.readFile(joinTreePath(savesPath, s)); err == nil {
 				pe.reset()
 
 				// needed when loading a file in a different midi mode
@@ -960,7 +1122,7 @@ func dialogOpen(d *dialog, sng *song, pe *patternEditor, p *player) {
 				p.signal <- playerSignal{typ: signalSendPitchRPN}
 
 				saveAutofill = s
-				exportAutofill = replaceSuffix(s, fileExt, ".mid")
+				exportAutofill = replaceSuffix(s, filepath.Ext(s), ".mid")
 			} else {
 				d.message(err.Error())
 			}
@@ -970,24 +1132,38 @@ func dialogOpen(d *dialog, sng *song, pe *patternEditor, p *player) {
 	})
 }
 
+// set d to an input dialog
+func dialogImportMidi(d *dialog, sng *song, pe *patternEditor, p *player) {
+	d.getPath("Import MIDI:", savesPath, ".mid", true, func(s string) {
+		s = addSuffixIfMissing(s, ".mid")
+		p.stop(true)
+		p.signal <- playerSignal{typ: signalResetChannels}
+		if err := sng.importSMF(joinTreePath(savesPath, s)); err == nil {
+			pe.reset()
+			p.signal <- playerSignal{typ: signalSendSystemOn}
+			p.signal <- playerSignal{typ: signalSendPitchRPN}
+			saveAutofill = replaceSuffix(s, ".mid", fileExt)
+			exportAutofill = s
+			statusf("Imported %s.", s)
+		} else {
+			d.message(err.Error())
+		}
+	})
+}
+
 // set d to an input dialog
 func dialogSaveAs(d *dialog, sng *song) {
-	d.getPath("Save song as:", savesPath, ".faun", false, func(s string) {
-		s = addSuffixIfMissing(s, fileExt)
+	d.getPath("Save song as:", savesPath, fileExt, false, func(s string) {
+		s = addSongSuffixIfMissing(s)
 		saveAutofill = s
 		if exportAutofill == "" {
-			exportAutofill = replaceSuffix(s, fileExt, ".mid")
+			exportAutofill = replaceSuffix(s, filepath.Ext(s), ".mid")
 		}
 		os.MkdirAll(joinTreePath(savesPath), 0755)
-		if f, err := os.Create(joinTreePath(savesPath, s)); err == nil {
-			defer f.Close()
-			if err := sng.write(f); err != nil {
-				d.message(err.Error())
-			} else {
-				statusf("Wrote %s.", s)
-			}
-		} else {
+		if err := sng.writeFile(joinTreePath(savesPath, s)); err != nil {
 			d.message(err.Error())
+		} else {
+			statusf("Wrote %s.", s)
 		}
 	})
 	d.input = saveAutofill
@@ -1014,6 +1190,61 @@ func dialogExportMidi(d *dialog, sng *song, p *player) {
 	d.updateCurTargets()
 }
 
+// set d to an input dialog chain
+func dialogExportMultitrackMidi(d *dialog, sng *song, p *player) {
+	d.getPath("Export song as:", exportsPath, ".mid", false, func(s string) {
+		s = addSuffixIfMissing(s, ".mid")
+		exportAutofill = s
+		if saveAutofill == "" {
+			saveAutofill = replaceSuffix(s, ".mid", fileExt)
+		}
+		d.getNamedInts("One MIDI track:", []int64{0}, smfLayoutTargets(), func(xs []int64) {
+			p.stop(true) // avoid race condition
+			os.MkdirAll(joinTreePath(exportsPath), 0755)
+			err := sng.exportMultitrackSMF(joinTreePath(exportsPath, s), int(xs[0]))
+			if err != nil {
+				d.message(err.Error())
+			} else {
+				statusf("Wrote %s.", s)
+			}
+		})
+	})
+	d.input = exportAutofill
+	d.updateCurTargets()
+}
+
+// set d to an input dialog
+func dialogExportMidiClip(d *dialog, sng *song, p *player) {
+	d.getPath("Export song as:", exportsPath, midiClipExt, false, func(s string) {
+		s = addSuffixIfMissing(s, midiClipExt)
+		p.stop(true) // avoid race condition
+		os.MkdirAll(joinTreePath(exportsPath), 0755)
+		if err := sng.exportMIDIClip(joinTreePath(exportsPath, s)); err != nil {
+			d.message(err.Error())
+		} else {
+			statusf("Wrote %s.", s)
+		}
+	})
+	d.input = replaceSuffix(exportAutofill, ".mid", midiClipExt)
+	d.updateCurTargets()
+}
+
+// set d to an input dialog
+func dialogExportAudio(d *dialog, sng *song, p *player) {
+	d.getPath("Render song to:", exportsPath, ".wav", false, func(s string) {
+		s = addSuffixIfMissing(s, ".wav")
+		p.stop(true) // avoid race condition
+		os.MkdirAll(joinTreePath(exportsPath), 0755)
+		if err := sng.exportWAV(joinTreePath(exportsPath, s)); err != nil {
+			d.message(err.Error())
+		} else {
+			statusf("Wrote %s.", s)
+		}
+	})
+	d.input = replaceSuffix(exportAutofill, ".mid", ".wav")
+	d.updateCurTargets()
+}
+
 // set d to a message dialog
 func dialogMidiInputs(d *dialog, drv *driver.Driver) {
 	if ins, err := drv.Ins(); err == nil {
@@ -1042,6 +1273,76 @@ func dialogMidiOutputs(d *dialog, drv *driver.Driver) {
 	}
 }
 
+// set d to an input dialog
+func dialogSelectMidiInput(d *dialog, mp *midiPorts) {
+	selectPort := func(i int) {
+		dialogSelectMidiPort(d, "Input port (index, name, or -1):", mp, true, func(spec portSpec) {
+			if err := mp.selectInput(i, spec); err != nil {
+				d.message(err.Error() + ".")
+			} else if port := mp.ins[i].port; port != nil {
+				statusf("Connected %s.", port)
+			}
+		})
+	}
+	if len(mp.ins) == 1 {
+		selectPort(0)
+	} else {
+		d.getInt("Index of MIDI input in inputs.csv list:", 0, int64(len(mp.ins)-1),
+			func(i int64) { selectPort(int(i)) })
+	}
+}
+
+// set d to an input dialog
+func dialogSelectMidiOutput(d *dialog, mp *midiPorts, p *player) {
+	selectPort := func(i int) {
+		dialogSelectMidiPort(d, "Output port (index or name):", mp, false, func(spec portSpec) {
+			if err := mp.selectOutput(i, spec); err != nil {
+				d.message(err.Error() + ".")
+			} else {
+				statusf("Connected %s.", mp.outs[i].portName())
+				p.signal <- playerSignal{typ: signalSendSystemOn}
+				p.signal <- playerSignal{typ: signalSendPitchRPN}
+			}
+		})
+	}
+	switch len(mp.outs) {
+	case 0:
+		d.message("No MIDI outputs are set in MidiOutPortNumber.")
+	case 1:
+		selectPort(0)
+	default:
+		d.getInt("Index of MIDI output in settings.csv list:", 0, int64(len(mp.outs)-1),
+			func(i int64) { selectPort(int(i)) })
+	}
+}
+
+// set d to an input dialog that completes port names
+func dialogSelectMidiPort(d *dialog, prompt string, mp *midiPorts, input bool,
+	action func(portSpec)) {
+	inNames, outNames, err := mp.portNames()
+	if err != nil {
+		d.message(err.Error())
+		return
+	}
+	names := outNames
+	if input {
+		names = inNames
+	}
+	targets := make([]*tabTarget, len(names))
+	size := 3
+	for i, name := range names {
+		targets[i] = &tabTarget{display: fmt.Sprintf("[%d] %s", i, name), value: name}
+		size = intMax(size, len(targets[i].display)+1)
+	}
+	*d = *newDialog(prompt, size, func(s string) {
+		if len(d.curTargets) > 0 && alphaRegexp.MatchString(s) {
+			s = d.curTargets[0].value
+		}
+		action(parsePortSpec(s))
+	})
+	d.targets, d.curTargets = targets, targets
+}
+
 // set d to an input dialog
 func dialogTrackSetChannel(d *dialog, sng *song, pe *patternEditor) {
 	d.getInt("Channel:", 1, numVirtualChannels, func(i int64) {
@@ -1089,6 +1390,14 @@ func addSuffixIfMissing(base, suffix string) string {
 	return base
 }
 
+// like addSuffixIfMissing, but accepts either song file extension
+func addSongSuffixIfMissing(s string) string {
+	if strings.HasSuffix(strings.ToLower(s), textFileExt) {
+		return s
+	}
+	return addSuffixIfMissing(s, fileExt)
+}
+
 // return the refresh rate of the display, according to SDL, or default FPS if
 // it's not available
 func getRefreshRate() int {
@@ -1129,6 +1438,16 @@ func sendSystemOn(wr writer.ChannelWriter, midiMode int) {
 		// assign all channels to lower zone
 		wr.SetChannel(0)
 		writer.RPN(wr, 0x00, 0x06, 0xf, 0)
+	case modeMTS, modeMTSNonRealTime:
+		writer.SysEx(wr, systemOnBytes[modeGM])
+		// select tuning on every channel except percussion
+		for i := uint8(0); i < numMidiChannels; i++ {
+			if i != percussionChannelIndex {
+				wr.SetChannel(i)
+				writer.RPN(wr, 0x00, 0x04, mtsTuningBank, 0)
+				writer.RPN(wr, 0x00, 0x03, mtsTuningProgram, 0)
+			}
+		}
 	}
 }
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"strings"
 
@@ -13,6 +14,7 @@ var shortcutsPath = joinTreePath(configPath, "shortcuts.csv")
 type menuBar struct {
 	menus     []*menu
 	shortcuts map[string]*menuItem
+	ccValues  [numMidiChannels][128]uint8 // from control surface inputs
 }
 
 // initialize the menu bar's properties and layout and those of its children
@@ -116,6 +118,39 @@ func (mb *menuBar) keyboardEvent(e *sdl.KeyboardEvent) bool {
 	return false
 }
 
+// respond to MIDI messages from a control surface, returning true if an
+// action was triggered
+func (mb *menuBar) midiEvent(msg []byte) bool {
+	if item, ok := mb.shortcuts[mb.formatMidiEvent(msg)]; ok && item.action != nil {
+		item.action()
+		return true
+	}
+	return false
+}
+
+// convert a MIDI message into a shortcut string, or "" if it doesn't trigger
+// shortcuts. notes trigger when pressed, and controllers when they cross the
+// middle of their range going up, like a footswitch.
+func (mb *menuBar) formatMidiEvent(msg []byte) string {
+	if len(msg) < 3 {
+		return ""
+	}
+	switch msg[0] & 0xf0 {
+	case 0x90:
+		if msg[2] > 0 {
+			return fmt.Sprintf("MIDI note %d", msg[1])
+		}
+	case 0xb0:
+		value := &mb.ccValues[msg[0]&0xf][msg[1]&0x7f]
+		prev := *value
+		*value = msg[2]
+		if prev < 64 && msg[2] >= 64 {
+			return fmt.Sprintf("MIDI CC %d", msg[1])
+		}
+	}
+	return ""
+}
+
 // convert a keyboard event into a shortcut string
 func formatKeyEvent(e *sdl.KeyboardEvent, useScancode bool) string {
 	keys := []string{}
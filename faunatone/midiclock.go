@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/midimessage/realtime"
+)
+
+const (
+	midiClockTicks = ticksPerBeat / 24 // ticks per MIDI clock pulse
+	midiBeatTicks  = ticksPerBeat / 4  // ticks per song position "MIDI beat"
+	maxSongPos     = 0x3fff
+)
+
+// raw MIDI message, for messages that the midi package encodes incorrectly
+type rawMessage []byte
+
+func (m rawMessage) Raw() []byte {
+	return m
+}
+
+func (m rawMessage) String() string {
+	return fmt.Sprintf("% x", []byte(m))
+}
+
+// return a song position pointer message for a position in MIDI beats
+func songPositionMessage(pos uint16) rawMessage {
+	return rawMessage{0xf2, byte(pos & 0x7f), byte(pos >> 7 & 0x7f)}
+}
+
+// return true if any output is sending MIDI clock
+func (p *player) sendsClock() bool {
+	for _, out := range p.outputs {
+		if out.clock {
+			return true
+		}
+	}
+	return false
+}
+
+// start external devices from a tick. clock pulses begin at the first MIDI
+// beat at or after the tick, since song position can't point between beats.
+func (p *player) startClock(tick int64) {
+	if !p.sendsClock() {
+		return
+	}
+	if p.playing {
+		p.writeClock(realtime.Stop)
+	}
+	beat := (tick + midiBeatTicks - 1) / midiBeatTicks
+	if beat > maxSongPos {
+		beat = maxSongPos
+	}
+	p.clockFrom = beat * midiBeatTicks
+	if beat == 0 {
+		p.writeClock(realtime.Start)
+	} else {
+		p.writeClock(songPositionMessage(uint16(beat)))
+		p.writeClock(realtime.Continue)
+	}
+}
+
+// send clock pulses due in the tick range [tickMin, tickMax]
+func (p *player) sendClockPulses(tickMin, tickMax int64) {
+	if !p.sendsClock() {
+		return
+	}
+	if tickMin < p.clockFrom {
+		tickMin = p.clockFrom
+	}
+	for tick := p.nextClockTick(tickMin - 1); tick <= tickMax; tick += midiClockTicks {
+		p.writeClock(realtime.TimingClock)
+	}
+}
+
+// stop external devices
+func (p *player) stopClock() {
+	if p.playing && p.sendsClock() {
+		p.writeClock(realtime.Stop)
+	}
+}
+
+// return the first tick after a tick that a clock pulse is due at
+func (p *player) nextClockTick(tick int64) int64 {
+	if tick < p.clockFrom {
+		return p.clockFrom
+	}
+	return (tick/midiClockTicks + 1) * midiClockTicks
+}
+
+// write a message to each output that sends clock
+func (p *player) writeClock(msg midi.Message) {
+	for _, out := range p.outputs {
+		if out.clock {
+			out.writer.Write(msg)
+		}
+	}
+}
+
+// send the player the signal for a MIDI clock, transport, or song position
+// message from an input
+func (p *player) clockMessage(msg []byte) {
+	switch msg[0] {
+	case 0xf2:
+		if len(msg) == 3 {
+			pos := int64(msg[1]) | int64(msg[2])<<7
+			p.signal <- playerSignal{typ: signalSongPosition, tick: pos * midiBeatTicks}
+		}
+	case 0xf8:
+		p.signal <- playerSignal{typ: signalClockPulse}
+	case 0xfa:
+		p.signal <- playerSignal{typ: signalClockStart}
+	case 0xfb:
+		p.signal <- playerSignal{typ: signalClockContinue}
+	case 0xfc:
+		p.signal <- playerSignal{typ: signalClockStop}
+	}
+}
+
+// respond to a signal from an external clock. after a start or continue,
+// each clock pulse plays up to the next 1/24 beat, starting with the events
+// at the song position.
+func (p *player) followClock(sig playerSignal) {
+	switch sig.typ {
+	case signalSongPosition:
+		if !p.playing {
+			p.songPos = sig.tick
+		}
+	case signalClockStart, signalClockContinue:
+		if sig.typ == signalClockStart {
+			p.songPos = 0
+		}
+		p.start(p.songPos)
+		p.lastTick = p.songPos - 1 // so that the first pulse plays songPos
+		p.clockNext = p.songPos
+		p.lastPulse = time.Time{}
+		p.setClock(true)
+	case signalClockStop:
+		if p.playing {
+			p.songPos = p.clockNext
+			p.halt()
+		}
+	case signalClockPulse:
+		if !p.playing {
+			break
+		}
+		now := time.Now()
+		if d := now.Sub(p.lastPulse); !p.lastPulse.IsZero() && d > 0 {
+			// smooth out jitter in the estimated tempo
+			bpm := float64(time.Minute) / float64(d*24)
+			p.bpm += (bpm - p.bpm) / 4
+		}
+		p.lastPulse = now
+		p.resumeChasedNotes(p.clockNext)
+		p.advance(p.clockNext)
+		p.clockNext += midiClockTicks
+		if _, ok := p.ticksToHorizon(); !ok {
+			p.songPos = p.clockNext
+			p.halt()
+		}
+	}
+}
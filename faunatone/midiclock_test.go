@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/writer"
+)
+
+// channel writer that records system messages and note ons
+type systemRecorder struct {
+	channel  uint8
+	messages [][]byte
+	notes    []uint8
+	notify   chan uint8 // also receives note ons, blocking, if not nil
+}
+
+func (sr *systemRecorder) Channel() uint8      { return sr.channel }
+func (sr *systemRecorder) SetChannel(ch uint8) { sr.channel = ch }
+
+func (sr *systemRecorder) Write(msg midi.Message) error {
+	if b := msg.Raw(); b[0] >= 0xf0 {
+		sr.messages = append(sr.messages, b)
+	} else if b[0]&0xf0 == 0x90 && b[2] > 0 {
+		sr.notes = append(sr.notes, b[1])
+		if sr.notify != nil {
+			sr.notify <- b[1]
+		}
+	}
+	return nil
+}
+
+func TestSongPositionMessage(t *testing.T) {
+	assert.Equal(t, rawMessage{0xf2, 0x05, 0x01}, songPositionMessage(133))
+}
+
+func TestMIDIClock(t *testing.T) {
+	s := newSong(nil)
+	s.Tracks[0].Events = []*trackEvent{
+		{Type: noteOnEvent, FloatData: 60, ByteData1: 100},
+		{Tick: ticksPerBeat * 2, Type: noteOffEvent},
+	}
+	sr, other := &systemRecorder{}, &systemRecorder{}
+	p := newPlayer(s, []writer.ChannelWriter{sr, other}, false)
+	p.outputs[0].clock = true
+	go p.run()
+	p.sendStopping = true
+
+	count := func(b byte) int {
+		n := 0
+		for _, msg := range sr.messages {
+			if msg[0] == b {
+				n++
+			}
+		}
+		return n
+	}
+
+	// from the start: 24 pulses per beat, including the downbeats at each end
+	p.signal <- playerSignal{typ: signalStart}
+	<-p.stopping
+	assert.Equal(t, []byte{0xfa}, sr.messages[0])
+	assert.Equal(t, []byte{0xf8}, sr.messages[1])
+	assert.Equal(t, 24*2+1, count(0xf8))
+	assert.Equal(t, []byte{0xfc}, sr.messages[len(sr.messages)-1])
+
+	// from between MIDI beats: pulses begin at the next MIDI beat
+	sr.messages = nil
+	p.signal <- playerSignal{typ: signalStart, tick: midiBeatTicks*2 + 10}
+	<-p.stopping
+	assert.Equal(t, []byte{0xf2, 3, 0}, sr.messages[0])
+	assert.Equal(t, []byte{0xfb}, sr.messages[1])
+	assert.Equal(t, 24*2+1-3*6, count(0xf8))
+	assert.Equal(t, []byte{0xfc}, sr.messages[len(sr.messages)-1])
+
+	assert.Empty(t, other.messages)
+}
+
+func TestExternalClock(t *testing.T) {
+	s := newSong(nil)
+	s.Tracks[0].Events = []*trackEvent{
+		{Type: noteOnEvent, FloatData: 60, ByteData1: 100},
+		{Tick: midiBeatTicks, Type: noteOnEvent, FloatData: 62, ByteData1: 100},
+		{Tick: midiBeatTicks * 2, Type: tempoEvent, FloatData: 60},
+		{Tick: midiBeatTicks * 3, Type: noteOnEvent, FloatData: 64, ByteData1: 100},
+		{Tick: ticksPerBeat, Type: noteOffEvent},
+	}
+	sr := &systemRecorder{}
+	p := newPlayer(s, []writer.ChannelWriter{sr}, false)
+	go p.run()
+	p.signal <- playerSignal{typ: signalToggleExternalClock}
+	pulses := func(n int) {
+		for i := 0; i < n; i++ {
+			p.clockMessage([]byte{0xf8})
+		}
+	}
+
+	// nothing plays until the first pulse after start
+	p.clockMessage([]byte{0xfa})
+	assert.Empty(t, sr.notes)
+	pulses(1)
+	pulses(6) // one MIDI beat, which plays the second note
+	pulses(6) // through the tempo change
+	p.clockMessage([]byte{0xfc})
+	p.stop(true)
+	assert.Equal(t, []uint8{60, 62}, sr.notes)
+	assert.NotEqual(t, 60.0, p.bpm) // tempo event was ignored
+
+	// continue from a song position
+	sr.notes = nil
+	p.clockMessage(songPositionMessage(3))
+	p.clockMessage([]byte{0xfb})
+	pulses(1)
+	p.stop(true)
+	assert.Equal(t, []uint8{64}, sr.notes)
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/midimessage/syscommon"
+	"gitlab.com/gomidi/midi/reader"
+	"gitlab.com/gomidi/midi/writer"
+)
+
+// how often to look for MIDI devices that were plugged in or unplugged
+const midiRescanInterval = 2 * time.Second
+
+// a MIDI port setting: an index into the driver's list of ports, or a
+// case-insensitive substring of a port name
+type portSpec struct {
+	index int // -1 if by name or none
+	name  string
+}
+
+// parse a port setting, which is a port index, -1 for none, or a name
+func parsePortSpec(s string) portSpec {
+	if i, err := strconv.Atoi(s); err == nil {
+		return portSpec{index: i}
+	}
+	return portSpec{index: -1, name: s}
+}
+
+// parse a space-separated list of port settings
+func parsePortSpecs(s string) []portSpec {
+	var specs []portSpec
+	for _, field := range strings.Fields(s) {
+		specs = append(specs, parsePortSpec(field))
+	}
+	return specs
+}
+
+// return true if the setting doesn't select any port
+func (ps portSpec) isNone() bool {
+	return ps.index < 0 && ps.name == ""
+}
+
+func (ps portSpec) String() string {
+	if ps.name != "" {
+		return fmt.Sprintf("%q", ps.name)
+	}
+	return fmt.Sprintf("index %d", ps.index)
+}
+
+// return the index of the first matching port name, or -1 if none match
+func (ps portSpec) match(names []string) int {
+	if ps.name != "" {
+		for i, name := range names {
+			if strings.Contains(strings.ToLower(name), strings.ToLower(ps.name)) {
+				return i
+			}
+		}
+	} else if ps.index >= 0 && ps.index < len(names) {
+		return ps.index
+	}
+	return -1
+}
+
+// midi writer for an output port that can be connected and disconnected
+// while the player is using it. writes while disconnected are dropped.
+type portWriter struct {
+	mutex   sync.Mutex
+	spec    portSpec
+	port    midi.Out
+	wr      *writer.Writer
+	channel uint8
+	queue   *sendQueue // if set, writes wait here until they're due
+}
+
+func (pw *portWriter) Channel() uint8 {
+	return pw.channel
+}
+
+func (pw *portWriter) SetChannel(ch uint8) {
+	pw.channel = ch
+}
+
+// write a message, or queue it if the writer has a send queue. errors from
+// queued writes are dropped.
+func (pw *portWriter) Write(msg midi.Message) error {
+	if pw.queue != nil {
+		pw.queue.send(func() { pw.write(msg) })
+		return nil
+	}
+	return pw.write(msg)
+}
+
+func (pw *portWriter) write(msg midi.Message) error {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	if pw.wr == nil {
+		return nil
+	}
+	return pw.wr.Write(msg)
+}
+
+func (pw *portWriter) setSendQueue(q *sendQueue) {
+	pw.queue = q
+}
+
+// open a port and write to it instead of the current one, if any
+func (pw *portWriter) connect(port midi.Out) error {
+	if err := port.Open(); err != nil {
+		return err
+	}
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	if pw.port != nil {
+		pw.port.Close()
+	}
+	pw.port, pw.wr = port, writer.New(port)
+	return nil
+}
+
+// close the current port, if any
+func (pw *portWriter) disconnect() {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	if pw.port != nil {
+		pw.port.Close()
+	}
+	pw.port, pw.wr = nil, nil
+}
+
+// return the name of the connected port, or "" if none
+func (pw *portWriter) portName() string {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	if pw.port == nil {
+		return ""
+	}
+	return pw.port.String()
+}
+
+// uses of MIDI input ports
+const (
+	inputKeymap     = iota // notes play the song keymap
+	inputPercussion        // notes play drum notes
+	inputControl           // notes and controllers trigger menu items
+)
+
+// a MIDI input port and how its messages are used
+type midiInput struct {
+	spec      portSpec
+	role      int
+	channels  uint16 // bit mask of channels to accept
+	transpose int    // semitones
+	port      midi.In
+}
+
+var midiInputsPath = joinTreePath(configPath, "inputs.csv")
+
+// load MIDI inputs from config files. if there are none, the port from the
+// MidiInPortNumber setting plays the keymap.
+func loadMIDIInputs(s *settings, warn func(string)) []*midiInput {
+	var ins []*midiInput
+	for _, embed := range []bool{true, false} {
+		path := midiInputsPath
+		if embed {
+			path = "config/inputs.csv"
+		}
+		records, err := readCSV(path, embed)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				warn(err.Error())
+			}
+			continue
+		}
+		for _, rec := range records {
+			if mi, err := parseMIDIInput(rec); err == nil {
+				ins = append(ins, mi)
+			} else {
+				warn(fmt.Sprintf("bad MIDI input record: %v: %v", rec, err))
+			}
+		}
+	}
+	if ins == nil {
+		ins = append(ins, &midiInput{
+			spec:     parsePortSpec(s.MidiInPortNumber),
+			role:     inputKeymap,
+			channels: 0xffff,
+		})
+	}
+	return ins
+}
+
+// parse a record of port, role, channels, and transposition
+func parseMIDIInput(rec []string) (*midiInput, error) {
+	if len(rec) != 4 {
+		return nil, fmt.Errorf("expected 4 fields")
+	}
+	mi := &midiInput{spec: parsePortSpec(rec[0])}
+	switch rec[1] {
+	case "keymap":
+		mi.role = inputKeymap
+	case "percussion":
+		mi.role = inputPercussion
+	case "control":
+		mi.role = inputControl
+	default:
+		return nil, fmt.Errorf("unknown role %q", rec[1])
+	}
+	channels, err := parseChannelMask(rec[2])
+	if err != nil {
+		return nil, err
+	}
+	mi.channels = channels
+	if mi.transpose, err = strconv.Atoi(rec[3]); err != nil {
+		return nil, err
+	}
+	return mi, nil
+}
+
+// parse "all" or a space-separated list of channels and ranges of channels,
+// numbered from 1, into a bit mask
+func parseChannelMask(s string) (uint16, error) {
+	if s == "all" {
+		return 0xffff, nil
+	}
+	var mask uint16
+	for _, field := range strings.Fields(s) {
+		bounds := strings.SplitN(field, "-", 2)
+		min, err := strconv.Atoi(bounds[0])
+		max := min
+		if err == nil && len(bounds) == 2 {
+			max, err = strconv.Atoi(bounds[1])
+		}
+		if err != nil || min < 1 || max > numMidiChannels || min > max {
+			return 0, fmt.Errorf("invalid channels %q", field)
+		}
+		for ch := min; ch <= max; ch++ {
+			mask |= 1 << (ch - 1)
+		}
+	}
+	return mask, nil
+}
+
+// a message from a MIDI input
+type inputMessage struct {
+	input *midiInput
+	msg   []byte
+}
+
+// return a message with the input's channel filtering and transposition
+// applied, or false if the message should be dropped
+func (mi *midiInput) filter(msg []byte) ([]byte, bool) {
+	if len(msg) == 0 || msg[0] < 0x80 || msg[0] >= 0xf0 {
+		return msg, true // not a channel message
+	}
+	if mi.channels&(1<<(msg[0]&0xf)) == 0 {
+		return nil, false
+	}
+	switch msg[0] & 0xf0 {
+	case 0x80, 0x90, 0xa0: // messages with keys
+		if len(msg) < 3 {
+			return nil, false
+		}
+		key := int(msg[1]) + mi.transpose
+		if key < 0 || key > 127 {
+			return nil, false
+		}
+		msg = []byte{msg[0], byte(key), msg[2]}
+	}
+	return msg, true
+}
+
+// the MIDI input and output ports selected by settings or the user, kept
+// connected to matching devices as they come and go
+type midiPorts struct {
+	drv      midi.Driver
+	ins      []*midiInput
+	messages chan inputMessage // from all inputs
+	clock    chan []byte       // clock, transport, and song position messages
+	outs     []*portWriter
+	lastScan time.Time
+	reported map[string]bool // errors from the last scan
+}
+
+func newMIDIPorts(drv midi.Driver, ins []*midiInput, outSpecs []portSpec) *midiPorts {
+	mp := &midiPorts{
+		drv:      drv,
+		ins:      ins,
+		messages: make(chan inputMessage, 100),
+		clock:    make(chan []byte, 100),
+	}
+	for _, spec := range outSpecs {
+		if !spec.isNone() {
+			mp.outs = append(mp.outs, &portWriter{spec: spec})
+		}
+	}
+	return mp
+}
+
+// return the writers for the output ports
+func (mp *midiPorts) writers() []writer.ChannelWriter {
+	wrs := make([]writer.ChannelWriter, len(mp.outs))
+	for i, pw := range mp.outs {
+		wrs[i] = pw
+	}
+	return wrs
+}
+
+// return the names of the available input and output ports
+func (mp *midiPorts) portNames() ([]string, []string, error) {
+	ins, err := mp.drv.Ins()
+	if err != nil {
+		return nil, nil, err
+	}
+	outs, err := mp.drv.Outs()
+	if err != nil {
+		return nil, nil, err
+	}
+	inNames, outNames := make([]string, len(ins)), make([]string, len(outs))
+	for i, in := range ins {
+		inNames[i] = in.String()
+	}
+	for i, out := range outs {
+		outNames[i] = out.String()
+	}
+	return inNames, outNames, nil
+}
+
+// select and connect the port for an input
+func (mp *midiPorts) selectInput(index int, spec portSpec) error {
+	mi := mp.ins[index]
+	mp.closeInput(mi)
+	mi.spec = spec
+	if spec.isNone() {
+		return nil
+	}
+	ins, err := mp.drv.Ins()
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(ins))
+	for i, in := range ins {
+		names[i] = in.String()
+	}
+	i := spec.match(names)
+	if i < 0 {
+		return fmt.Errorf("MIDI input %s not found", spec)
+	}
+	if err := ins[i].Open(); err != nil {
+		return err
+	}
+	sendClock := func(msg []byte) {
+		select {
+		case mp.clock <- msg:
+		default:
+		}
+	}
+	rd := reader.New(reader.NoLogger(),
+		reader.Each(func(pos *reader.Position, msg midi.Message) {
+			if spp, ok := msg.(syscommon.SPP); ok {
+				sendClock(songPositionMessage(spp.Number()))
+				return
+			}
+			select {
+			case mp.messages <- inputMessage{mi, msg.Raw()}:
+			default:
+			}
+		}),
+		reader.RTClock(func() { sendClock([]byte{0xf8}) }),
+		reader.RTStart(func() { sendClock([]byte{0xfa}) }),
+		reader.RTContinue(func() { sendClock([]byte{0xfb}) }),
+		reader.RTStop(func() { sendClock([]byte{0xfc}) }),
+	)
+	if err := rd.ListenTo(ins[i]); err != nil {
+		ins[i].Close()
+		return err
+	}
+	mi.port = ins[i]
+	return nil
+}
+
+// stop listening to and close an input's port, if any
+func (mp *midiPorts) closeInput(mi *midiInput) {
+	if mi.port != nil {
+		mi.port.StopListening()
+		mi.port.Close()
+		mi.port = nil
+	}
+}
+
+// select and connect the port for an output
+func (mp *midiPorts) selectOutput(index int, spec portSpec) error {
+	pw := mp.outs[index]
+	pw.disconnect()
+	pw.spec = spec
+	outs, err := mp.drv.Outs()
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(outs))
+	for i, out := range outs {
+		names[i] = out.String()
+	}
+	i := spec.match(names)
+	if i < 0 {
+		return fmt.Errorf("MIDI output %s not found", spec)
+	}
+	return pw.connect(outs[i])
+}
+
+// close all ports
+func (mp *midiPorts) close() {
+	for _, mi := range mp.ins {
+		mp.closeInput(mi)
+	}
+	for _, pw := range mp.outs {
+		pw.disconnect()
+	}
+}
+
+// if it's time, look for devices that were unplugged or plugged in, and
+// reconnect the ports whose devices reappeared. returns the names of output
+// ports that were connected, which will need their state resent, and any
+// ports that failed to connect.
+func (mp *midiPorts) rescan(now time.Time) ([]string, error) {
+	if now.Sub(mp.lastScan) < midiRescanInterval {
+		return nil, nil
+	}
+	mp.lastScan = now
+	inNames, outNames, err := mp.portNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for i, mi := range mp.ins {
+		if mi.port != nil && !slices.Contains(inNames, mi.port.String()) {
+			mp.closeInput(mi)
+		}
+		if mi.port == nil && mi.spec.match(inNames) >= 0 {
+			if err := mp.selectInput(i, mi.spec); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	var connected []string
+	for i, pw := range mp.outs {
+		if name := pw.portName(); name != "" && !slices.Contains(outNames, name) {
+			pw.disconnect()
+		}
+		if pw.portName() == "" && pw.spec.match(outNames) >= 0 {
+			if err := mp.selectOutput(i, pw.spec); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			connected = append(connected, pw.portName())
+		}
+	}
+	return connected, mp.newErrors(errs)
+}
+
+// combine the errors from a scan, leaving out any that the last scan already
+// reported, so that a port that keeps failing isn't reported every time
+func (mp *midiPorts) newErrors(errs []error) error {
+	reported := make(map[string]bool)
+	var msgs []string
+	for _, err := range errs {
+		if msg := err.Error(); !reported[msg] {
+			if !mp.reported[msg] {
+				msgs = append(msgs, msg)
+			}
+			reported[msg] = true
+		}
+	}
+	mp.reported = reported
+	if msgs == nil {
+		return nil
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/writer"
+)
+
+// output port that records what's written to it
+type fakeOut struct {
+	name    string
+	open    bool
+	written [][]byte
+}
+
+func (fo *fakeOut) Open() error             { fo.open = true; return nil }
+func (fo *fakeOut) Close() error            { fo.open = false; return nil }
+func (fo *fakeOut) IsOpen() bool            { return fo.open }
+func (fo *fakeOut) Number() int             { return 0 }
+func (fo *fakeOut) String() string          { return fo.name }
+func (fo *fakeOut) Underlying() interface{} { return nil }
+
+func (fo *fakeOut) Write(b []byte) (int, error) {
+	fo.written = append(fo.written, append([]byte{}, b...))
+	return len(b), nil
+}
+
+// input port that can fail to open, as when another program holds it
+type fakeIn struct {
+	name    string
+	open    bool
+	openErr error
+}
+
+func (fi *fakeIn) Open() error {
+	fi.open = fi.openErr == nil
+	return fi.openErr
+}
+
+func (fi *fakeIn) Close() error                                  { fi.open = false; return nil }
+func (fi *fakeIn) IsOpen() bool                                  { return fi.open }
+func (fi *fakeIn) Number() int                                   { return 0 }
+func (fi *fakeIn) String() string                                { return fi.name }
+func (fi *fakeIn) Underlying() interface{}                       { return nil }
+func (fi *fakeIn) SetListener(func(data []byte, dt int64)) error { return nil }
+func (fi *fakeIn) StopListening() error                          { return nil }
+
+// driver whose devices can be plugged in and unplugged
+type fakeDriver struct {
+	ins  []midi.In
+	outs []midi.Out
+}
+
+func (fd *fakeDriver) Ins() ([]midi.In, error)   { return fd.ins, nil }
+func (fd *fakeDriver) Outs() ([]midi.Out, error) { return fd.outs, nil }
+func (fd *fakeDriver) String() string            { return "fake" }
+func (fd *fakeDriver) Close() error              { return nil }
+
+func TestPortSpec(t *testing.T) {
+	names := []string{"Midi Through Port-0", "USB MIDI Interface MIDI 1"}
+	assert.Equal(t, []portSpec{{index: 1}, {index: -1, name: "usb"}}, parsePortSpecs("1 usb"))
+	assert.Equal(t, 1, parsePortSpec("usb").match(names))
+	assert.Equal(t, 0, parsePortSpec("0").match(names))
+	assert.Equal(t, -1, parsePortSpec("2").match(names))
+	assert.Equal(t, -1, parsePortSpec("synth").match(names))
+	assert.True(t, parsePortSpec("-1").isNone())
+}
+
+func TestMIDIPortsRescan(t *testing.T) {
+	through, usb := &fakeOut{name: "Midi Through"}, &fakeOut{name: "USB MIDI"}
+	drv := &fakeDriver{outs: []midi.Out{through}}
+	mp := newMIDIPorts(drv, nil, parsePortSpecs("usb"))
+	assert.NotNil(t, mp.selectOutput(0, mp.outs[0].spec))
+	wr := mp.writers()[0]
+	assert.Nil(t, writer.NoteOn(wr, 60, 100)) // dropped while disconnected
+
+	// device is plugged in
+	now := time.Now()
+	drv.outs = append(drv.outs, usb)
+	connected, err := mp.rescan(now)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"USB MIDI"}, connected)
+	assert.True(t, usb.open)
+	writer.NoteOn(wr, 60, 100)
+	assert.Equal(t, [][]byte{{0x90, 60, 100}}, usb.written)
+
+	// nothing changes until the next scan is due
+	drv.outs = drv.outs[:1]
+	connected, _ = mp.rescan(now.Add(time.Second))
+	assert.Empty(t, connected)
+	assert.True(t, usb.open)
+
+	// device is unplugged, then plugged back in
+	connected, _ = mp.rescan(now.Add(midiRescanInterval))
+	assert.Empty(t, connected)
+	assert.False(t, usb.open)
+	drv.outs = append(drv.outs, usb)
+	connected, _ = mp.rescan(now.Add(midiRescanInterval * 2))
+	assert.Equal(t, []string{"USB MIDI"}, connected)
+	assert.True(t, usb.open)
+	assert.False(t, through.open)
+
+	// an input that fails to open doesn't keep outputs from connecting
+	pad, synth := &fakeIn{name: "Drum Pad", openErr: errors.New("device busy")},
+		&fakeOut{name: "Synth"}
+	mi := &midiInput{spec: parsePortSpec("pad"), role: inputPercussion, channels: 0xffff}
+	drv = &fakeDriver{ins: []midi.In{pad}, outs: []midi.Out{synth}}
+	mp = newMIDIPorts(drv, []*midiInput{mi}, parsePortSpecs("synth"))
+	connected, err = mp.rescan(now)
+	assert.ErrorContains(t, err, "device busy")
+	assert.Equal(t, []string{"Synth"}, connected)
+	assert.Nil(t, mi.port)
+
+	// the same error isn't reported again
+	_, err = mp.rescan(now.Add(midiRescanInterval))
+	assert.Nil(t, err)
+	assert.Nil(t, mi.port)
+
+	// the input connects once it's free, and closes when unplugged
+	pad.openErr = nil
+	_, err = mp.rescan(now.Add(midiRescanInterval * 2))
+	assert.Nil(t, err)
+	assert.Equal(t, midi.In(pad), mi.port)
+	drv.ins = nil
+	mp.rescan(now.Add(midiRescanInterval * 3))
+	assert.Nil(t, mi.port)
+	assert.False(t, pad.open)
+}
+
+func TestParseMIDIInput(t *testing.T) {
+	mi, err := parseMIDIInput([]string{"nanopad", "percussion", "1-3 10", "-12"})
+	if assert.Nil(t, err) {
+		assert.Equal(t, portSpec{index: -1, name: "nanopad"}, mi.spec)
+		assert.Equal(t, inputPercussion, mi.role)
+		assert.Equal(t, uint16(0x207), mi.channels)
+		assert.Equal(t, -12, mi.transpose)
+	}
+	_, err = parseMIDIInput([]string{"0", "drums", "all", "0"})
+	assert.NotNil(t, err)
+	_, err = parseMIDIInput([]string{"0", "keymap", "0-16", "0"})
+	assert.NotNil(t, err)
+	_, err = parseMIDIInput([]string{"0", "keymap", "all"})
+	assert.NotNil(t, err)
+}
+
+func TestMIDIInputFilter(t *testing.T) {
+	mi := &midiInput{channels: 1 << 9, transpose: 12}
+	msg, ok := mi.filter([]byte{0x99, 60, 100})
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0x99, 72, 100}, msg)
+	_, ok = mi.filter([]byte{0x90, 60, 100}) // wrong channel
+	assert.False(t, ok)
+	_, ok = mi.filter([]byte{0x89, 120, 0}) // out of range
+	assert.False(t, ok)
+	msg, ok = mi.filter([]byte{0xb9, 60, 100}) // not transposed
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0xb9, 60, 100}, msg)
+}
+
+func TestMenuBarMIDIEvent(t *testing.T) {
+	n := 0
+	item := &menuItem{label: "Stop", action: func() { n++ }}
+	mb := &menuBar{shortcuts: map[string]*menuItem{
+		"MIDI note 36": item,
+		"MIDI CC 64":   item,
+	}}
+	assert.True(t, mb.midiEvent([]byte{0x90, 36, 100}))
+	assert.False(t, mb.midiEvent([]byte{0x90, 36, 0}))
+	assert.False(t, mb.midiEvent([]byte{0x90, 37, 100}))
+
+	// controllers trigger once per press
+	assert.True(t, mb.midiEvent([]byte{0xb0, 64, 127}))
+	assert.False(t, mb.midiEvent([]byte{0xb0, 64, 100}))
+	assert.False(t, mb.midiEvent([]byte{0xb0, 64, 0}))
+	assert.True(t, mb.midiEvent([]byte{0xb0, 64, 127}))
+	assert.Equal(t, 3, n)
+}
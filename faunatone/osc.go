@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/midimessage/channel"
+)
+
+// Open Sound Control output. the player drives an oscWriter like any other
+// midi writer, and it sends each message it understands as an OSC message in
+// its own UDP packet. notes carry their exact pitches, so as with MIDI 2.0
+// output, each virtual channel gets its own channel and notes are identified
+// by channel and key.
+//
+// messages sent:
+//
+//	/note_on ,iiffi channel key pitch hz velocity
+//	/note_off ,iiff channel key pitch hz
+//	/note_pitch ,iiff channel key pitch hz (pitch change of a sounding note)
+//	/cc ,iii channel controller value
+//	/program ,iiii channel program bankMSB bankLSB
+//	/pressure ,ii channel pressure
+//	/poly_pressure ,iii channel key pressure
+
+// midi writer that sends OSC messages
+type oscWriter struct {
+	conn    io.Writer // each write is one packet
+	channel uint8
+	queue   *sendQueue // if set, packets wait here until they're due
+
+	// per-channel state needed for translation
+	bank  [numMidiChannels][2]uint8 // MSB, LSB
+	pitch [numMidiChannels]map[uint8]float64
+	notes [numMidiChannels][128]bool
+}
+
+func newOSCWriter(conn io.Writer) *oscWriter {
+	ow := &oscWriter{conn: conn}
+	for i := range ow.pitch {
+		ow.pitch[i] = make(map[uint8]float64)
+	}
+	return ow
+}
+
+// open a UDP connection to an OSC server at a host:port address
+func dialOSC(addr string) (*oscWriter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not open OSC output %q: %v", addr, err)
+	}
+	return newOSCWriter(conn), nil
+}
+
+func (ow *oscWriter) Channel() uint8 {
+	return ow.channel
+}
+
+func (ow *oscWriter) SetChannel(ch uint8) {
+	ow.channel = ch
+}
+
+func (ow *oscWriter) Write(msg midi.Message) error {
+	switch msg := msg.(type) {
+	case channel.NoteOn:
+		if msg.Velocity() == 0 {
+			return ow.noteOff(msg.Channel(), msg.Key())
+		}
+		ch, key := msg.Channel(), msg.Key()
+		ow.notes[ch][key] = true
+		p := ow.keyPitch(ch, key)
+		return ow.send("/note_on", int32(ch), int32(key), float32(p), float32(pitchToHz(p)),
+			int32(msg.Velocity()))
+	case channel.NoteOff:
+		return ow.noteOff(msg.Channel(), msg.Key())
+	case channel.NoteOffVelocity:
+		return ow.noteOff(msg.Channel(), msg.Key())
+	case channel.ControlChange:
+		switch msg.Controller() {
+		case ccBankMSB:
+			ow.bank[msg.Channel()][0] = msg.Value()
+		case ccBankLSB:
+			ow.bank[msg.Channel()][1] = msg.Value()
+		}
+		return ow.send("/cc", int32(msg.Channel()), int32(msg.Controller()), int32(msg.Value()))
+	case channel.ProgramChange:
+		bank := ow.bank[msg.Channel()]
+		return ow.send("/program", int32(msg.Channel()), int32(msg.Program()),
+			int32(bank[0]), int32(bank[1]))
+	case channel.Aftertouch:
+		return ow.send("/pressure", int32(msg.Channel()), int32(msg.Pressure()))
+	case channel.PolyAftertouch:
+		return ow.send("/poly_pressure", int32(msg.Channel()), int32(msg.Key()),
+			int32(msg.Pressure()))
+	}
+	return nil
+}
+
+func (ow *oscWriter) noteOff(ch, key uint8) error {
+	p := ow.keyPitch(ch, key)
+	ow.notes[ch][key] = false
+	delete(ow.pitch[ch], key)
+	return ow.send("/note_off", int32(ch), int32(key), float32(p), float32(pitchToHz(p)))
+}
+
+// return the exact pitch of a key, defaulting to the key's own pitch
+func (ow *oscWriter) keyPitch(ch, key uint8) float64 {
+	if p, ok := ow.pitch[ch][key]; ok {
+		return p
+	}
+	return float64(key)
+}
+
+// set the pitch of a key on the current channel. this applies to the next
+// note on, or immediately if the key is already sounding.
+func (ow *oscWriter) setExactPitch(key uint8, p float64) {
+	ow.pitch[ow.channel][key] = p
+	if ow.notes[ow.channel][key] {
+		ow.send("/note_pitch", int32(ow.channel), int32(key), float32(p), float32(pitchToHz(p)))
+	}
+}
+
+func (ow *oscWriter) setSendQueue(q *sendQueue) {
+	ow.queue = q
+}
+
+// send a message, or queue it if the writer has a send queue. errors from
+// queued sends are dropped.
+func (ow *oscWriter) send(addr string, args ...interface{}) error {
+	b := encodeOSCMessage(addr, args...)
+	if ow.queue != nil {
+		ow.queue.send(func() { ow.conn.Write(b) })
+		return nil
+	}
+	_, err := ow.conn.Write(b)
+	return err
+}
+
+// return an OSC message with int32 and float32 arguments
+func encodeOSCMessage(addr string, args ...interface{}) []byte {
+	tags := ","
+	for _, arg := range args {
+		switch arg.(type) {
+		case int32:
+			tags += "i"
+		case float32:
+			tags += "f"
+		}
+	}
+	buf := &bytes.Buffer{}
+	writeOSCString(buf, addr)
+	writeOSCString(buf, tags)
+	for _, arg := range args {
+		binary.Write(buf, binary.BigEndian, arg)
+	}
+	return buf.Bytes()
+}
+
+// write a null-terminated string padded to a multiple of four bytes
+func writeOSCString(buf *bytes.Buffer, s string) {
+	buf.WriteString(s)
+	buf.Write(make([]byte, 4-len(s)%4))
+}
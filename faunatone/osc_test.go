@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gomidi/midi/writer"
+)
+
+// records each written packet
+type packetRecorder struct {
+	packets [][]byte
+}
+
+func (pr *packetRecorder) Write(b []byte) (int, error) {
+	pr.packets = append(pr.packets, append([]byte{}, b...))
+	return len(b), nil
+}
+
+// return the address and arguments of an OSC message
+func decodeOSCMessage(b []byte) (string, []interface{}) {
+	readString := func() string {
+		n := bytes.IndexByte(b, 0)
+		s := string(b[:n])
+		b = b[n+4-n%4:]
+		return s
+	}
+	addr, tags := readString(), readString()
+	var args []interface{}
+	for _, tag := range tags[1:] {
+		v := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		if tag == 'f' {
+			args = append(args, math.Float32frombits(v))
+		} else {
+			args = append(args, int32(v))
+		}
+	}
+	return addr, args
+}
+
+func TestEncodeOSCMessage(t *testing.T) {
+	assert.Equal(t, []byte("/cc\x00,iii\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x07\x00\x00\x00\x40"),
+		encodeOSCMessage("/cc", int32(1), int32(7), int32(64)))
+	assert.Equal(t, []byte("/x\x00\x00,f\x00\x00\x3f\x80\x00\x00"),
+		encodeOSCMessage("/x", float32(1)))
+}
+
+func TestOSCWriter(t *testing.T) {
+	s := newSong(nil)
+	s.Tracks[0].Events = []*trackEvent{
+		{Type: noteOnEvent, FloatData: 69.5, ByteData1: 100},
+		{Tick: ticksPerBeat / 2, Type: pitchBendEvent, FloatData: 70},
+		{Tick: ticksPerBeat, Type: noteOffEvent},
+	}
+	pr := &packetRecorder{}
+	p := newPlayer(s, []writer.ChannelWriter{newOSCWriter(pr)}, false)
+	go p.run()
+	p.sendStopping = true
+	p.signal <- playerSignal{typ: signalStart}
+	<-p.stopping
+
+	// collect note pitches by address
+	notes := make(map[string][]float64)
+	for _, b := range pr.packets {
+		addr, args := decodeOSCMessage(b)
+		switch addr {
+		case "/note_on", "/note_off", "/note_pitch":
+			pitch, hz := args[2].(float32), args[3].(float32)
+			assert.InDelta(t, pitchToHz(float64(pitch)), float64(hz), 0.01)
+			notes[addr] = append(notes[addr], float64(pitch))
+		}
+		if addr == "/note_on" {
+			assert.Equal(t, int32(100), args[4])
+		}
+	}
+	assert.Equal(t, []float64{69.5}, notes["/note_on"])
+	assert.Equal(t, []float64{70}, notes["/note_pitch"])
+	assert.Equal(t, []float64{70}, notes["/note_off"])
+}
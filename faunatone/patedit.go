@@ -56,6 +56,9 @@ type patternEditor struct {
 	historyIndex     int // index of action that undo will undo
 	historySizeLimit int
 	followSong       bool
+	recordMode       bool // record MIDI input during playback
+	recordQuantize   bool // round recorded notes to the division
+	recording        *recording
 	prevPlayPos      int64
 	offDivAlphaMod   uint8
 	shiftScrollMult  int
@@ -186,7 +189,9 @@ func (pe *patternEditor) draw(r *sdl.Renderer, dst *sdl.Rect, playPos int64) {
 	r.FillRect(&sdl.Rect{X: dst.X, Y: dst.Y, W: dst.W, H: pe.headerHeight})
 	for _, t := range pe.song.Tracks {
 		if x+pe.trackWidth > dst.X && x < dst.X+dst.W {
-			pe.printer.draw(r, "channel "+strconv.Itoa(int(t.Channel)+1), x, dst.Y+padding)
+			pe.printer.draw(r, "channel "+strconv.Itoa(int(t.Channel)+1)+
+				conditionalString(t.Mute, " M", "")+conditionalString(t.Solo, " S", ""),
+				x, dst.Y+padding)
 		}
 		x += pe.trackWidth
 	}
@@ -197,9 +202,11 @@ func (pe *patternEditor) draw(r *sdl.Renderer, dst *sdl.Rect, playPos int64) {
 	dst.Y += pe.headerHeight
 	dst.H -= pe.headerHeight
 	x = dst.X - pe.scrollX
+	viewMin := pe.firstTickOnScreen()
+	viewMax := int64(pe.scrollY+dst.H)*ticksPerBeat/int64(pe.beatHeight) + 1
 	for _, t := range pe.song.Tracks {
 		if x+pe.trackWidth > dst.X && x < dst.X+dst.W {
-			for _, e := range t.Events {
+			for _, e := range t.eventsInRange(viewMin, viewMax) {
 				y := dst.Y + int32(e.Tick*int64(pe.beatHeight)/ticksPerBeat) - pe.scrollY
 				if y >= dst.Y && y < dst.Y+dst.H {
 					alpha := uint8(255)
@@ -372,10 +379,8 @@ func (pe *patternEditor) deleteArea(trackMin, trackMax int, tickMin, tickMax int
 	ea := &editAction{}
 	for i, t := range pe.song.Tracks {
 		if i >= trackMin && i <= trackMax {
-			for _, te := range t.Events {
-				if te.Tick >= tickMin && te.Tick <= tickMax {
-					ea.beforeEvents = append(ea.beforeEvents, te.clone())
-				}
+			for _, te := range t.eventsInRange(tickMin, tickMax) {
+				ea.beforeEvents = append(ea.beforeEvents, te.clone())
 			}
 		}
 	}
@@ -397,12 +402,10 @@ func (pe *patternEditor) copy() {
 	pe.copyTicks = tickMax - tickMin
 	pe.copiedEvents = make([][]*trackEvent, trackMax-trackMin+1)
 	for i := range pe.copiedEvents {
-		for _, te := range pe.song.Tracks[trackMin+i].Events {
-			if te.Tick >= tickMin && te.Tick <= tickMax {
-				te2 := te.clone()
-				te2.Tick -= tickMin
-				pe.copiedEvents[i] = append(pe.copiedEvents[i], te2)
-			}
+		for _, te := range pe.song.Tracks[trackMin+i].eventsInRange(tickMin, tickMax) {
+			te2 := te.clone()
+			te2.Tick -= tickMin
+			pe.copiedEvents[i] = append(pe.copiedEvents[i], te2)
 		}
 	}
 }
@@ -449,6 +452,24 @@ func (pe *patternEditor) setTrackChannel(channel uint8) {
 	pe.doNewEditAction(ea)
 }
 
+// toggle the mute flag of selected tracks, based on the first one
+func (pe *patternEditor) toggleMute() {
+	trackMin, trackMax, _, _ := pe.getSelection()
+	mute := !pe.song.Tracks[trackMin].Mute
+	for i := trackMin; i <= trackMax; i++ {
+		pe.song.Tracks[i].Mute = mute
+	}
+}
+
+// toggle the solo flag of selected tracks, based on the first one
+func (pe *patternEditor) toggleSolo() {
+	trackMin, trackMax, _, _ := pe.getSelection()
+	solo := !pe.song.Tracks[trackMin].Solo
+	for i := trackMin; i <= trackMax; i++ {
+		pe.song.Tracks[i].Solo = solo
+	}
+}
+
 // add a new track for each track in the selection
 func (pe *patternEditor) insertTracks() {
 	trackMin, trackMax, _, _ := pe.getSelection()
@@ -465,7 +486,9 @@ func (pe *patternEditor) deleteTracks() {
 	ea := &editAction{}
 	for i := trackMin; i <= trackMax && len(pe.song.Tracks)-len(ea.beforeTracks) > 1; i++ {
 		t := pe.song.Tracks[i]
-		ea.beforeTracks = append(ea.beforeTracks, newTrack(t.Channel, i))
+		t2 := newTrack(t.Channel, i)
+		t2.Mute, t2.Solo = t.Mute, t.Solo
+		ea.beforeTracks = append(ea.beforeTracks, t2)
 		for _, te := range t.Events {
 			ea.beforeEvents = append(ea.beforeEvents, te.clone())
 		}
@@ -572,12 +595,10 @@ func (pe *patternEditor) modifyRefPitch(delta float64) {
 // set ref pitch to the top-left corner of selection
 func (pe *patternEditor) captureRefPitch() {
 	trackMin, _, tickMin, _ := pe.getSelection()
-	for _, te := range pe.song.Tracks[trackMin].Events {
-		if (te.Type == noteOnEvent || te.Type == pitchBendEvent) && te.Tick == tickMin {
-			pe.refPitch = te.FloatData
-			pe.updateRefPitchDisplay()
-			return
-		}
+	te := pe.song.Tracks[trackMin].getEventAtTick(tickMin)
+	if te != nil && (te.Type == noteOnEvent || te.Type == pitchBendEvent) {
+		pe.refPitch = te.FloatData
+		pe.updateRefPitchDisplay()
 	}
 }
 
@@ -618,12 +639,12 @@ func (pe *patternEditor) interpolateSelection() {
 	ea := &editAction{}
 	for i := trackMin; i <= trackMax; i++ {
 		var startEvt, endEvt *trackEvent
-		for _, te := range pe.song.Tracks[i].Events {
+		for _, te := range pe.song.Tracks[i].eventsInRange(tickMin, tickMax) {
 			if te.Tick == tickMin {
 				startEvt = te
 			} else if te.Tick == tickMax {
 				endEvt = te
-			} else if te.Tick > tickMin && te.Tick < tickMax {
+			} else {
 				ea.beforeEvents = append(ea.beforeEvents, te.clone())
 			}
 		}
@@ -726,9 +747,7 @@ func (pe *patternEditor) redo() error {
 
 // do an edit action in the "forward" order, without modifying the history
 func (pe *patternEditor) doEditAction(ea *editAction) {
-	for _, te := range ea.beforeEvents {
-		pe.removeEvent(te)
-	}
+	pe.removeEvents(ea.beforeEvents)
 	removedTracks := 0
 	for _, t := range ea.beforeTracks {
 		stillExists := false
@@ -760,9 +779,7 @@ func (pe *patternEditor) doEditAction(ea *editAction) {
 	if ts := ea.tickShift; ts != nil {
 		pe.applyTickShift(ts)
 	}
-	for _, te := range ea.afterEvents {
-		pe.addEvent(te)
-	}
+	pe.addEvents(ea.afterEvents)
 	if ts := ea.trackShift; ts != nil {
 		pe.applyTrackShift(ts.min, ts.max, ts.offset)
 	}
@@ -775,22 +792,26 @@ func (pe *patternEditor) doEditAction(ea *editAction) {
 	}
 }
 
-// remove a matching event from the song (based on track and tick only)
-func (pe *patternEditor) removeEvent(te *trackEvent) {
-	t := pe.song.Tracks[te.track]
-	for i, te2 := range t.Events {
-		if te2.Tick == te.Tick {
-			t.Events = append(t.Events[:i], t.Events[i+1:]...)
-			break
-		}
+// remove matching events from the song (based on track and tick only)
+func (pe *patternEditor) removeEvents(tes []*trackEvent) {
+	ticks := make(map[int][]int64)
+	for _, te := range tes {
+		ticks[te.track] = append(ticks[te.track], te.Tick)
+	}
+	for i, ticks := range ticks {
+		pe.song.Tracks[i].removeEvents(ticks)
 	}
 }
 
-// add a copy of the event to the song
-func (pe *patternEditor) addEvent(te *trackEvent) {
-	te2 := te.clone()
-	t := pe.song.Tracks[te.track]
-	t.Events = append(t.Events, te2)
+// add copies of the events to the song
+func (pe *patternEditor) addEvents(tes []*trackEvent) {
+	added := make(map[int][]*trackEvent)
+	for _, te := range tes {
+		added[te.track] = append(added[te.track], te.clone())
+	}
+	for i, tes := range added {
+		pe.song.Tracks[i].addEvents(tes)
+	}
 }
 
 // remove a matching track from the song (based on index only)
@@ -869,11 +890,8 @@ func (pe *patternEditor) doNewTickShift(factor int64) {
 	beforeEvents := []*trackEvent{}
 	if factor < 0 {
 		for i := trackMin; i <= trackMax; i++ {
-			for _, te := range pe.song.Tracks[i].Events {
-				if te.Tick >= tickMin && te.Tick+offset < tickMin {
-					beforeEvents = append(beforeEvents, te)
-				}
-			}
+			beforeEvents = append(beforeEvents,
+				pe.song.Tracks[i].eventsInRange(tickMin, tickMin-offset-1)...)
 		}
 	}
 	pe.doNewEditAction(&editAction{
@@ -890,10 +908,8 @@ func (pe *patternEditor) doNewTickShift(factor int64) {
 // apply a tick shift edit action
 func (pe *patternEditor) applyTickShift(ts *tickShift) {
 	for i := ts.trackMin; i <= ts.trackMax; i++ {
-		for _, te := range pe.song.Tracks[i].Events {
-			if te.Tick >= ts.position {
-				te.Tick += ts.offset
-			}
+		for _, te := range pe.song.Tracks[i].eventsInRange(ts.position, math.MaxInt64) {
+			te.Tick += ts.offset
 		}
 	}
 }
@@ -957,10 +973,8 @@ func (pe *patternEditor) forEventsInSelection(fn func(*track, *trackEvent)) {
 	trackMin, trackMax, tickMin, tickMax := pe.getSelection()
 	for i := trackMin; i <= trackMax; i++ {
 		t := pe.song.Tracks[i]
-		for _, te := range t.Events {
-			if te.Tick >= tickMin && te.Tick <= tickMax {
-				fn(t, te)
-			}
+		for _, te := range t.eventsInRange(tickMin, tickMax) {
+			fn(t, te)
 		}
 	}
 }
@@ -141,3 +141,8 @@ func reduce(num, den int) (int, int) {
 	}
 	return num, den
 }
+
+// return the frequency of a MIDI pitch in Hz, with A4 at 440 Hz
+func pitchToHz(p float64) float64 {
+	return 440 * math.Pow(2, (p-69)/12)
+}
@@ -2,10 +2,11 @@ package main
 
 import (
 	"math"
-	"sort"
 	"sync"
 	"time"
 
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/midimessage/meta"
 	"gitlab.com/gomidi/midi/writer"
 )
 
@@ -13,6 +14,7 @@ import (
 type playerSignal struct {
 	typ   playerSignalType
 	tick  int64
+	end   int64 // end of loop, exclusive
 	world int
 	event *trackEvent
 }
@@ -22,6 +24,7 @@ type playerSignalType uint8
 const (
 	signalContinue playerSignalType = iota
 	signalStart
+	signalLoop
 	signalStop
 	signalEvent
 	signalSongChanged
@@ -29,6 +32,13 @@ const (
 	signalSendSystemOn
 	signalResetChannels
 	signalCycleMIDIMode
+	signalMuteChanged
+	signalToggleExternalClock
+	signalClockStart
+	signalClockContinue
+	signalClockStop
+	signalClockPulse
+	signalSongPosition
 )
 
 const (
@@ -45,6 +55,10 @@ const (
 	mt32MaxChannel = 8
 	mpeMinChannel  = 1
 	mpeMaxChannel  = 15
+
+	mtsDeviceID      = 0x7f // all devices
+	mtsTuningBank    = 0
+	mtsTuningProgram = 0
 )
 
 var systemOnBytes = [][]byte{
@@ -71,16 +85,49 @@ type player struct {
 	redrawChan   chan bool // send true on this when a signal is received
 	polyErrCount int       // # of times polyphony limit was exceeded
 	exportOutput *int
+	ignoreMute   bool          // play tracks regardless of mute and solo
+	chasedNotes  []*trackEvent // notes and bends to resume when starting
 
 	// ignore signalContinue messages with world < this.
 	// increment world when signalStop and signalStart are sent.
 	world int
+
+	// play position as of the last signal, used to estimate the current
+	// position from other goroutines
+	clockMutex sync.Mutex
+	clockTick  int64
+	clockTime  time.Time
+	clockBPM   float64
+	playing    bool
+
+	clockFrom int64 // first tick to send MIDI clock at
+
+	// loop region, if loopEnd > loopStart
+	loopStart int64
+	loopEnd   int64
+
+	// real-time scheduling
+	tempo     *tempoMap
+	startTime time.Time  // time of tempo map offset 0
+	sender    *sendQueue // holds messages until they're due; nil if not realtime
+	timing    timingStats
+
+	// external MIDI clock state
+	external  bool
+	songPos   int64 // tick to continue from
+	clockNext int64 // tick to play up to at the next clock pulse
+	lastPulse time.Time
 }
 
 type midiOutput struct {
 	writer   writer.ChannelWriter
 	channels []*channelState
 	midiMode int
+	clock    bool // send MIDI clock and transport messages
+
+	// like channelState.keyNoteOff, but for the whole output. MTS tunings
+	// apply to every channel, so keys in MTS modes are allocated here.
+	keyNoteOff [128]int64
 }
 
 func (out *midiOutput) sendPitchBendRPN(semitones, cents uint8) {
@@ -101,6 +148,7 @@ func newPlayer(s *song, wrs []writer.ChannelWriter, realtime bool) *player {
 		stopping:     make(chan struct{}),
 		outputs:      make([]*midiOutput, len(wrs)),
 		virtChannels: make([]*channelState, numVirtualChannels),
+		ignoreMute:   !realtime && !exportMuteSolo,
 	}
 	for i, wr := range wrs {
 		out := &midiOutput{
@@ -116,61 +164,75 @@ func newPlayer(s *song, wrs []writer.ChannelWriter, realtime bool) *player {
 	for i := range p.virtChannels {
 		p.virtChannels[i] = newChannelState(s.MidiMode, i, true)
 	}
+	if realtime {
+		p.sender = newSendQueue(&p.timing)
+		for _, wr := range wrs {
+			if qw, ok := wr.(queueingWriter); ok {
+				qw.setSendQueue(p.sender)
+			}
+		}
+	}
 	return p
 }
 
 // start signal-handling loop
 func (p *player) run() {
+	if p.sender != nil {
+		go p.sender.run()
+	}
 	p.broadcastPitchBendRPN()
 	for sig := range p.signal {
 		switch sig.typ {
-		case signalStart:
-			p.world++
-			for _, out := range p.outputs {
-				for _, c := range out.channels {
-					c.lastNoteOff = 0 // reset; all channels are fair game now
-				}
+		case signalStart, signalLoop:
+			if p.external {
+				// wait for the external clock to continue from here
+				p.halt()
+				p.songPos = sig.tick
+				break
 			}
-			p.determineVirtualChannelStates(sig.tick)
-			p.lastTick = sig.tick
-			p.findHorizon()
-			for i := range p.song.Tracks {
-				p.playTrackEvents(i, sig.tick, sig.tick)
+			p.loopStart, p.loopEnd = 0, 0
+			if sig.typ == signalLoop {
+				p.loopStart, p.loopEnd = sig.tick, sig.end
+			}
+			p.timing.reset()
+			p.playFrom(sig.tick, time.Now())
+			sig2 := playerSignal{
+				typ:   signalContinue,
+				tick:  sig.tick,
+				world: p.world,
 			}
 			go func() {
-				p.signal <- playerSignal{
-					typ:   signalContinue,
-					tick:  sig.tick,
-					world: p.world,
-				}
+				p.signal <- sig2
 			}()
 		case signalContinue:
 			if sig.world < p.world {
 				break
 			}
-
-			for _, out := range p.outputs {
-				if wr, ok := out.writer.(*writer.SMF); ok {
-					wr.SetDelta(uint32(sig.tick - p.lastEvtTick))
+			if p.sender != nil {
+				p.sender.setTime(p.targetTime(sig.tick))
+			}
+			if p.loopEnd > p.loopStart && sig.tick >= p.loopEnd {
+				// jump back, ending notes at the boundary
+				for i := range p.song.Tracks {
+					p.noteOff(i, p.loopEnd)
 				}
+				p.playFrom(p.loopStart, p.targetTime(sig.tick))
+			} else {
+				p.advance(sig.tick)
 			}
-
-			for i := range p.song.Tracks {
-				p.playTrackEvents(i, p.lastTick+1, sig.tick)
+			// compute the next signal here, since the state may have
+			// changed by the time the goroutine sends it
+			tth, ok := p.ticksToHorizon()
+			sig2 := playerSignal{
+				typ:   signalContinue,
+				tick:  p.lastTick + tth,
+				world: p.world,
 			}
-
-			p.lastTick = sig.tick
-			p.findHorizon()
-
+			target := p.targetTime(sig2.tick)
 			go func() {
-				if tth, ok := p.ticksToHorizon(); ok {
-					sig2 := playerSignal{
-						typ:   signalContinue,
-						tick:  p.lastTick + tth,
-						world: p.world,
-					}
+				if ok {
 					if p.realtime {
-						time.Sleep(p.durationFromTicks(tth))
+						waitUntil(target.Add(-schedulerLookahead))
 					}
 					p.signal <- sig2
 				} else {
@@ -178,13 +240,19 @@ func (p *player) run() {
 				}
 			}()
 		case signalStop:
-			p.world++
-			for i := range p.song.Tracks {
-				p.noteOff(i, p.lastTick)
-			}
+			p.halt()
 			if p.sendStopping {
 				p.stopping <- struct{}{}
 			}
+		case signalToggleExternalClock:
+			p.halt()
+			p.external = !p.external
+		case signalClockStart, signalClockContinue, signalClockStop, signalClockPulse,
+			signalSongPosition:
+			if !p.external {
+				continue // don't redraw for ignored clock messages
+			}
+			p.followClock(sig)
 		case signalEvent:
 			p.playEvent(sig.event)
 		case signalSendPitchRPN:
@@ -205,6 +273,8 @@ func (p *player) run() {
 			}
 		case signalSongChanged:
 			p.findHorizon()
+		case signalMuteChanged:
+			p.silenceMutedTracks()
 		case signalCycleMIDIMode:
 			p.song.MidiMode = (p.song.MidiMode + 1) % numMidiModes
 			go func() {
@@ -213,6 +283,10 @@ func (p *player) run() {
 			}()
 		}
 
+		if p.sender != nil {
+			p.sender.setTime(time.Time{}) // anything else is sent right away
+		}
+
 		// if we got any signal, assume redraw is needed
 		if p.redrawChan != nil {
 			p.redrawChan <- true
@@ -220,6 +294,84 @@ func (p *player) run() {
 	}
 }
 
+// reset channels and prepare to play from a tick
+func (p *player) start(tick int64) {
+	p.world++
+	for _, out := range p.outputs {
+		for _, c := range out.channels {
+			c.lastNoteOff = 0 // reset; all channels are fair game now
+			c.keyNoteOff = [128]int64{}
+		}
+		out.keyNoteOff = [128]int64{}
+	}
+	p.determineVirtualChannelStates(tick)
+	p.tempo = newTempoMap(tick, p.bpm)
+	p.lastTick = tick
+	p.findHorizon()
+	p.startClock(tick)
+}
+
+// start playing from a tick, which is due at a time
+func (p *player) playFrom(tick int64, at time.Time) {
+	p.start(tick)
+	p.startTime = at
+	p.sendClockPulses(tick, tick)
+	p.resumeChasedNotes(tick)
+	for i := range p.song.Tracks {
+		p.playTrackEvents(i, tick, tick)
+	}
+	p.updateTempoMap(tick)
+	p.setClock(true)
+}
+
+// play events after the last tick, up to and including a tick
+func (p *player) advance(tick int64) {
+	for _, out := range p.outputs {
+		switch wr := out.writer.(type) {
+		case *writer.SMF:
+			wr.SetDelta(uint32(tick - p.lastEvtTick))
+		case *synthWriter:
+			wr.advanceTo(p.tempo.timeAt(tick))
+		case *smfRecorder:
+			wr.tick = tick
+		case *umpWriter:
+			wr.tick = tick
+		}
+	}
+
+	p.sendClockPulses(p.lastTick+1, tick)
+	for i := range p.song.Tracks {
+		p.playTrackEvents(i, p.lastTick+1, tick)
+	}
+
+	p.lastTick = tick
+	p.updateTempoMap(tick)
+	p.findHorizon()
+	p.setClock(true)
+}
+
+// add any tempo change at a tick to the tempo map
+func (p *player) updateTempoMap(tick int64) {
+	if !p.external && p.bpm != p.tempo.bpm() {
+		p.tempo.setTempo(tick, p.bpm)
+	}
+}
+
+// return the time that a tick is due to be played at
+func (p *player) targetTime(tick int64) time.Time {
+	return p.startTime.Add(p.tempo.timeAt(tick))
+}
+
+// stop playback and silence notes
+func (p *player) halt() {
+	p.world++
+	p.stopClock()
+	p.setClock(false)
+	for i := range p.song.Tracks {
+		p.noteOff(i, p.lastTick)
+	}
+}
+
 // clean up active notes and reset pitch bend sensitivity to default
 func (p *player) cleanup() {
 	for i := range p.song.Tracks {
@@ -249,16 +401,13 @@ func (p *player) findTrackHorizon(i int) {
 	if i >= len(p.song.Tracks) {
 		return
 	}
-	t := p.song.Tracks[i]
-	for _, te := range t.Events {
-		if te.Tick > p.lastTick && te.Tick < p.horizon[i] {
-			p.horizon[i] = te.Tick
-		}
+	if tick, ok := p.song.Tracks[i].nextEventTick(p.lastTick); ok {
+		p.horizon[i] = tick
 	}
 	p.horizonMutex.Unlock()
 }
 
-// return the ticks until the next event
+// return the ticks until the next event or MIDI clock pulse
 func (p *player) ticksToHorizon() (int64, bool) {
 	horizon, ok := int64(math.MaxInt64), false
 	p.horizonMutex.Lock()
@@ -268,31 +417,69 @@ func (p *player) ticksToHorizon() (int64, bool) {
 		}
 	}
 	p.horizonMutex.Unlock()
+	if p.loopEnd > p.loopStart && horizon > p.loopEnd {
+		horizon, ok = p.loopEnd, true
+	}
+	if ok && p.sendsClock() {
+		if tick := p.nextClockTick(p.lastTick); tick < horizon {
+			horizon = tick
+		}
+	}
 	return horizon - p.lastTick, ok
 }
 
-// convert a tick count to a time.Duration
-func (p *player) durationFromTicks(t int64) time.Duration {
-	return time.Duration(int64(float64(int64(time.Minute)*t/ticksPerBeat) / p.bpm))
+// record the current play position for playPos
+func (p *player) setClock(playing bool) {
+	now := time.Now()
+	if p.realtime && playing && !p.external {
+		now = p.targetTime(p.lastTick)
+	}
+	p.clockMutex.Lock()
+	p.clockTick, p.clockTime, p.clockBPM = p.lastTick, now, p.bpm
+	p.playing = playing
+	p.clockMutex.Unlock()
+}
+
+// return the estimated current play position, and whether the song is playing.
+// this is safe to call from other goroutines.
+func (p *player) playPos() (int64, bool) {
+	p.clockMutex.Lock()
+	defer p.clockMutex.Unlock()
+	if !p.playing {
+		return p.clockTick, false
+	}
+	elapsed := time.Since(p.clockTime).Minutes()
+	return p.clockTick + int64(elapsed*p.clockBPM*ticksPerBeat), true
 }
 
-// play events on track i in the tick range [tickMin, tickMax]
+// play events on track i in the tick range [tickMin, tickMax]. notes on
+// muted tracks only end the previous note, so that other events still keep
+// channel state current.
 func (p *player) playTrackEvents(i int, tickMin, tickMax int64) {
-	for _, te := range p.song.Tracks[i].Events {
-		if te.Tick >= tickMin && te.Tick <= tickMax {
+	t := p.song.Tracks[i]
+	audible := p.ignoreMute || p.song.trackAudible(t)
+	for _, te := range t.eventsInRange(tickMin, tickMax) {
+		if !audible && (te.Type == noteOnEvent || te.Type == drumNoteOnEvent) {
+			p.noteOff(i, te.Tick)
+		} else {
 			p.playEvent(te)
 		}
 	}
 }
 
+// end notes on tracks that shouldn't be heard
+func (p *player) silenceMutedTracks() {
+	for i, t := range p.song.Tracks {
+		if !p.song.trackAudible(t) {
+			p.noteOff(i, p.lastTick)
+		}
+	}
+}
+
 // return the midi output for a track.
 // always returns non-nil if the player has at least one output.
 func (p *player) trackOutput(t *track) *midiOutput {
-	i := p.virtChannels[t.Channel].output
-	if i >= len(p.outputs) {
-		i = len(p.outputs) - 1
-	}
-	return p.outputs[i]
+	return p.outputs[p.trackOutputIndex(t)]
 }
 
 // play a single event; i is track index
@@ -303,11 +490,16 @@ func (p *player) playEvent(te *trackEvent) {
 	if te.Type != midiOutputEvent && !p.trackOutputEnabled(t) {
 		return
 	}
+	defer setSourceTrack(out.writer, setSourceTrack(out.writer, i))
 	switch te.Type {
 	case noteOnEvent:
 		p.lastEvtTick = te.Tick
 		p.noteOff(i, te.Tick)
 		vcs := p.virtChannels[t.Channel]
+		if isMTSMode(vcs.midiMode) || hasPerNotePitch(out.writer) {
+			p.playMTSNoteOn(te, out)
+			break
+		}
 		var stolen bool
 		t.midiChannel, stolen = pickInactiveChannel(out.channels, vcs.midiMin, vcs.midiMax, vcs.midiMode)
 		for j, t2 := range p.song.Tracks {
@@ -333,28 +525,14 @@ func (p *player) playEvent(te *trackEvent) {
 			writer.Pitchbend(out.writer, bend)
 			writer.Aftertouch(out.writer, 0) // the MPE spec says so
 			writer.ControlChange(out.writer, ccTimbre, vcs.controllers[ccTimbre])
+			setExactPitch(out.writer, note, te.FloatData)
 			writer.NoteOn(out.writer, note, te.ByteData1)
 			// ...then write again for synths that don't support pre-writing!
 			writer.Pitchbend(out.writer, bend)
 			writer.Aftertouch(out.writer, vcs.pressure)
 			// TODO: master channel CCs
 		} else {
-			for i, v := range vcs.controllers {
-				if mcs.controllers[i] != v {
-					writer.ControlChange(out.writer, uint8(i), v)
-					mcs.controllers[i] = v
-				}
-			}
-			if mcs.program != vcs.program {
-				writer.ControlChange(out.writer, ccBankMSB, uint8(vcs.program>>8))
-				writer.ControlChange(out.writer, ccBankLSB, uint8(vcs.program>>16))
-				writer.ProgramChange(out.writer, uint8(vcs.program))
-				mcs.program = vcs.program
-			}
-			if mcs.pressure != vcs.pressure {
-				writer.Aftertouch(out.writer, vcs.pressure)
-				mcs.pressure = vcs.pressure
-			}
+			syncChannelState(out.writer, vcs, mcs)
 			if mcs.bend != bend {
 				writer.Pitchbend(out.writer, bend)
 				mcs.bend = bend
@@ -363,10 +541,12 @@ func (p *player) playEvent(te *trackEvent) {
 				writer.PolyAftertouch(out.writer, note, t.pressure)
 				mcs.keyPressure[note] = t.pressure
 			}
+			setExactPitch(out.writer, note, te.FloatData)
 			writer.NoteOn(out.writer, note, te.ByteData1)
 		}
 		t.activeNote = note
 		mcs.lastNoteOff = -1
+		mcs.keyNoteOff[note] = -1
 	case drumNoteOnEvent:
 		p.lastEvtTick = te.Tick
 		p.noteOff(i, te.Tick)
@@ -390,6 +570,14 @@ func (p *player) playEvent(te *trackEvent) {
 			out.writer.SetChannel(0)
 			writer.ControlChange(out.writer, te.ByteData1, te.ByteData2)
 			out.channels[0].controllers[te.ByteData1] = te.ByteData2
+		} else if vcs.midiMode == modeMPE {
+			// timbre is per-note, so only this track's member channel
+			if t.midiChannel != byteNil {
+				p.lastEvtTick = te.Tick
+				out.writer.SetChannel(t.midiChannel)
+				writer.ControlChange(out.writer, te.ByteData1, te.ByteData2)
+				out.channels[t.midiChannel].controllers[te.ByteData1] = te.ByteData2
+			}
 		} else {
 			for _, t2 := range p.song.Tracks {
 				if t2.Channel == t.Channel && t2.midiChannel != byteNil {
@@ -401,13 +589,21 @@ func (p *player) playEvent(te *trackEvent) {
 			}
 		}
 	case pitchBendEvent:
-		if note := t.activeNote; note != byteNil {
+		mode := p.virtChannels[t.Channel].midiMode
+		if note := t.activeNote; note != byteNil && (isMTSMode(mode) || hasPerNotePitch(out.writer)) {
+			p.lastEvtTick = te.Tick
+			if isMTSMode(mode) {
+				sendNoteTuning(out.writer, note, te.FloatData, mode == modeMTS)
+			}
+			setExactPitch(out.writer, note, te.FloatData)
+		} else if note != byteNil {
 			p.lastEvtTick = te.Tick
 			bend := int16((te.FloatData - float64(note)) * 8192.0 /
 				getBendSemitones(p.virtChannels[t.Channel].midiMode))
 			p.virtChannels[t.Channel].bend = bend
 			out.writer.SetChannel(t.midiChannel)
 			writer.Pitchbend(out.writer, bend)
+			setExactPitch(out.writer, note, te.FloatData)
 			out.channels[t.midiChannel].bend = bend
 		}
 	case channelPressureEvent:
@@ -422,7 +618,13 @@ func (p *player) playEvent(te *trackEvent) {
 		}
 	case keyPressureEvent:
 		t.pressure = te.ByteData1
-		if t.activeNote != byteNil {
+		if t.activeNote != byteNil && p.virtChannels[t.Channel].midiMode == modeMPE {
+			// per-note pressure is channel pressure on the member channel
+			p.lastEvtTick = te.Tick
+			out.writer.SetChannel(t.midiChannel)
+			writer.Aftertouch(out.writer, t.pressure)
+			out.channels[t.midiChannel].pressure = t.pressure
+		} else if t.activeNote != byteNil {
 			p.lastEvtTick = te.Tick
 			out.writer.SetChannel(t.midiChannel)
 			writer.PolyAftertouch(out.writer, t.activeNote, t.pressure)
@@ -452,38 +654,21 @@ func (p *player) playEvent(te *trackEvent) {
 			}
 		}
 	case tempoEvent:
-		if te.FloatData != 0 {
+		if p.external {
+			break // tempo comes from the clock
+		} else if te.FloatData != 0 {
 			p.bpm = te.FloatData
 		} else {
 			p.bpm *= float64(te.ByteData1) / float64(te.ByteData2)
 		}
-		if wr, ok := out.writer.(*writer.SMF); ok {
+		if writesMeta(out.writer) {
 			p.lastEvtTick = te.Tick
-			writer.TempoBPM(wr, p.bpm)
+			out.writer.Write(meta.FractionalBPM(p.bpm))
 		}
 	case textEvent:
-		if wr, ok := out.writer.(*writer.SMF); ok {
+		if writesMeta(out.writer) {
 			p.lastEvtTick = te.Tick
-			switch te.ByteData1 {
-			case 2:
-				writer.Copyright(wr, te.TextData)
-			case 3:
-				writer.TrackSequenceName(wr, te.TextData)
-			case 4:
-				writer.Instrument(wr, te.TextData)
-			case 5:
-				writer.Lyric(wr, te.TextData)
-			case 6:
-				writer.Marker(wr, te.TextData)
-			case 7:
-				writer.Cuepoint(wr, te.TextData)
-			case 8:
-				writer.Program(wr, te.TextData)
-			case 9:
-				writer.Device(wr, te.TextData)
-			default:
-				writer.Text(wr, te.TextData)
-			}
+			out.writer.Write(textMetaMessage(te.ByteData1, te.TextData))
 		}
 	case releaseLenEvent:
 		p.virtChannels[t.Channel].releaseLen = int64(math.Round(te.FloatData * ticksPerBeat))
@@ -514,21 +699,172 @@ func (p *player) playEvent(te *trackEvent) {
 		outputIndex := p.virtChannels[t.Channel].output
 		for i, vcs := range p.virtChannels {
 			if vcs.output == outputIndex {
-				p.virtChannels[i] = newChannelState(mode, int(t.Channel), true)
+				p.virtChannels[i] = newChannelState(mode, i, true)
 				p.virtChannels[i].output = vcs.output
 			}
 		}
-		out.midiMode = mode
-		sendSystemOn(out.writer, mode)
-		for i := range out.channels {
-			out.channels[i] = newChannelState(mode, i, false)
-		}
-		out.sendPitchBendRPN(uint8(getBendSemitones(mode)), 0)
+		p.setOutputMode(out, mode)
 	default:
 		println("unhandled event type in player.playTrackEvents")
 	}
 }
 
+// play a note on a fixed channel, retuning a free key to the note's pitch.
+// this is also used for outputs with per-note pitch, which don't need
+// retuning.
+func (p *player) playMTSNoteOn(te *trackEvent, out *midiOutput) {
+	t := p.song.Tracks[te.track]
+	vcs := p.virtChannels[t.Channel]
+	t.midiChannel = clamp(vcs.midiMin, 0, numMidiChannels-1)
+	if !isMTSMode(vcs.midiMode) && vcs.midiMin == 0 && vcs.midiMax == numMidiChannels-1 {
+		// no range directive; use the same channel as MTS modes would
+		t.midiChannel = pinnedMidiChannel(int(t.Channel))
+	}
+	out.writer.SetChannel(t.midiChannel)
+	mcs := out.channels[t.midiChannel]
+	syncChannelState(out.writer, vcs, mcs)
+	keys := &mcs.keyNoteOff
+	if isMTSMode(vcs.midiMode) {
+		keys = &out.keyNoteOff
+	}
+	key, stolen := pickInactiveKey(keys, te.FloatData, te.Tick)
+	if stolen {
+		p.polyErrCount++
+		for j, t2 := range p.song.Tracks {
+			if t2 != t && t2.activeNote == key && p.trackOutput(t2) == out &&
+				(t2.midiChannel == t.midiChannel || keys == &out.keyNoteOff) {
+				p.noteOff(j, te.Tick)
+				out.writer.SetChannel(t.midiChannel)
+			}
+		}
+	}
+	if isMTSMode(vcs.midiMode) {
+		sendNoteTuning(out.writer, key, te.FloatData, vcs.midiMode == modeMTS)
+	}
+	if mcs.keyPressure[key] != t.pressure {
+		writer.PolyAftertouch(out.writer, key, t.pressure)
+		mcs.keyPressure[key] = t.pressure
+	}
+	setExactPitch(out.writer, key, te.FloatData)
+	writer.NoteOn(out.writer, key, te.ByteData1)
+	t.activeNote = key
+	mcs.lastNoteOff = -1
+	mcs.keyNoteOff[key] = -1
+	out.keyNoteOff[key] = -1
+}
+
+// write controller, program, and pressure messages needed to make a midi
+// channel's state match a virtual channel's
+func syncChannelState(wr writer.ChannelWriter, vcs, mcs *channelState) {
+	for i, v := range vcs.controllers {
+		if mcs.controllers[i] != v {
+			writer.ControlChange(wr, uint8(i), v)
+			mcs.controllers[i] = v
+		}
+	}
+	if mcs.program != vcs.program {
+		writer.ControlChange(wr, ccBankMSB, uint8(vcs.program>>8))
+		writer.ControlChange(wr, ccBankLSB, uint8(vcs.program>>16))
+		writer.ProgramChange(wr, uint8(vcs.program))
+		mcs.program = vcs.program
+	}
+	if mcs.pressure != vcs.pressure {
+		writer.Aftertouch(wr, vcs.pressure)
+		mcs.pressure = vcs.pressure
+	}
+}
+
+// send an MTS single note tuning change, using the real-time variant if
+// realtime is true
+func sendNoteTuning(wr writer.ChannelWriter, key uint8, p float64, realtime bool) {
+	semitone, fraction := mtsFrequencyData(p)
+	data := []byte{0x01, key, semitone, uint8(fraction >> 7), uint8(fraction & 0x7f)}
+	if realtime {
+		sysex(append([]byte{0x7f, mtsDeviceID, 0x08, 0x02, mtsTuningProgram}, data...),
+			wr, modeMTS)
+	} else {
+		sysex(append([]byte{0x7e, mtsDeviceID, 0x08, 0x07, mtsTuningBank, mtsTuningProgram}, data...),
+			wr, modeMTSNonRealTime)
+	}
+}
+
+// return true if the writer is for a file that can hold meta-events
+func writesMeta(wr writer.ChannelWriter) bool {
+	switch wr.(type) {
+	case *writer.SMF, *smfRecorder, *umpWriter:
+		return true
+	}
+	return false
+}
+
+// return the meta-event for a text event of a given type
+func textMetaMessage(typ byte, text string) midi.Message {
+	switch typ {
+	case 2:
+		return meta.Copyright(text)
+	case 3:
+		return meta.TrackSequenceName(text)
+	case 4:
+		return meta.Instrument(text)
+	case 5:
+		return meta.Lyric(text)
+	case 6:
+		return meta.Marker(text)
+	case 7:
+		return meta.Cuepoint(text)
+	case 8:
+		return meta.Program(text)
+	case 9:
+		return meta.Device(text)
+	}
+	return meta.Text(text)
+}
+
+// writers that record which track each message is for implement this
+type sourceTrackWriter interface {
+	setSourceTrack(i int) int
+}
+
+// tell the writer which track the following messages are for, if it cares,
+// and return the previous track
+func setSourceTrack(wr writer.ChannelWriter, i int) int {
+	if stw, ok := wr.(sourceTrackWriter); ok {
+		return stw.setSourceTrack(i)
+	}
+	return i
+}
+
+// writers that send to devices in real time implement this, so that the
+// player can process playback ahead of time and queue their sends
+type queueingWriter interface {
+	setSendQueue(q *sendQueue)
+}
+
+// writers that can play exact pitches implement this, so that they don't
+// have to rely on the rounding of note numbers and pitch bend
+type exactPitchWriter interface {
+	setExactPitch(key uint8, p float64)
+}
+
+// tell the writer the exact pitch of a key on its current channel, if it
+// cares. call this after writing any pitch bend for the note.
+func setExactPitch(wr writer.ChannelWriter, key uint8, p float64) {
+	if epw, ok := wr.(exactPitchWriter); ok {
+		epw.setExactPitch(key, p)
+	}
+}
+
+// return the MTS semitone and 14-bit fraction values for a pitch
+func mtsFrequencyData(p float64) (uint8, uint16) {
+	p = math.Max(0, math.Min(127, p))
+	semitone := math.Floor(p)
+	fraction := math.Round((p - semitone) * 0x4000)
+	if fraction >= 0x4000 {
+		semitone, fraction = semitone+1, 0
+	}
+	return uint8(semitone), uint16(fraction)
+}
+
 func sysex(data []byte, wr writer.ChannelWriter, midiMode int) {
 	b := make([]byte, len(data))
 	copy(b, data)
@@ -564,57 +900,161 @@ func (p *player) noteOff(i int, tick int64) {
 		if !p.trackOutputEnabled(t) {
 			return
 		}
+		// this can happen in the middle of another track's event
+		defer setSourceTrack(out.writer, setSourceTrack(out.writer, i))
 		out.writer.SetChannel(t.midiChannel)
 		if out.midiMode == modeMPE {
 			writer.Aftertouch(out.writer, 0) // the MPE spec says so
 		}
 		writer.NoteOff(out.writer, activeNote)
 		t.activeNote = byteNil
-		out.channels[t.midiChannel].lastNoteOff = tick + p.virtChannels[t.Channel].releaseLen
+		mcs := out.channels[t.midiChannel]
+		mcs.lastNoteOff = tick + p.virtChannels[t.Channel].releaseLen
+		mcs.keyNoteOff[activeNote] = mcs.lastNoteOff
+		out.keyNoteOff[activeNote] = mcs.lastNoteOff
 	}
 }
 
-// set virtual channel states based on everything that happens from the start
-// of the song up to (but not including) a given tick
-// TODO this seems expensive to do every time play needs to happen; it's
-// probably worth looking into keeping events sorted in the first place. it
-// would also be cheaper to have a different slice for each virtual channel,
-// since channels can't affect each other's states and (n log n + m log m) <
-// (n+m log n+m)
+// set virtual channel, output, and mode states based on everything that
+// happens from the start of the song up to (but not including) a given tick,
+// and remember the notes still held at that tick so that they can be resumed.
 func (p *player) determineVirtualChannelStates(tick int64) {
-	events := []*trackEvent{}
-	for _, t := range p.song.Tracks {
-		for _, te := range t.Events {
-			if te.Tick < tick {
-				events = append(events, te)
-			}
-		}
+	if !p.external {
+		p.bpm = defaultBPM
 	}
-	sort.Slice(events, func(i, j int) bool {
-		if events[i].Tick < events[j].Tick {
-			return true
-		} else if events[i].Tick == events[j].Tick && events[i].track < events[j].track {
-			return true
-		}
-		return false
-	})
-	for _, te := range events {
+	for i := range p.virtChannels {
+		p.virtChannels[i] = newChannelState(p.song.MidiMode, i, true)
+	}
+	outModes := make([]int, len(p.outputs))
+	for i := range outModes {
+		outModes[i] = p.song.MidiMode
+	}
+	reverbs := make([]*trackEvent, len(p.outputs))
+	held := make([]*trackEvent, len(p.song.Tracks))
+	bends := make([]*trackEvent, len(p.song.Tracks))
+
+	lists := make([][]*trackEvent, len(p.song.Tracks))
+	for i, t := range p.song.Tracks {
+		t.pressure = 0
+		lists[i] = t.eventsInRange(math.MinInt64, tick-1)
+	}
+	for _, te := range mergeEvents(lists) {
 		t := p.song.Tracks[te.track]
+		vcs := p.virtChannels[t.Channel]
 		switch te.Type {
+		case noteOnEvent:
+			held[te.track], bends[te.track] = te, nil
+		case drumNoteOnEvent, noteOffEvent:
+			held[te.track], bends[te.track] = nil, nil
+		case pitchBendEvent:
+			if held[te.track] != nil {
+				bends[te.track] = te
+			}
 		case controllerEvent:
-			p.virtChannels[t.Channel].controllers[te.ByteData1] = te.ByteData2
+			vcs.controllers[te.ByteData1] = te.ByteData2
+		case channelPressureEvent:
+			vcs.pressure = te.ByteData1
+		case keyPressureEvent:
+			t.pressure = te.ByteData1
 		case programEvent:
-			p.virtChannels[t.Channel].program = uint32(te.ByteData1) +
+			vcs.program = uint32(te.ByteData1) +
 				uint32(te.ByteData2)<<8 +
 				uint32(te.ByteData3)<<16
 		case tempoEvent:
-			if te.FloatData != 0 {
+			if p.external {
+				break // tempo comes from the clock
+			} else if te.FloatData != 0 {
 				p.bpm = te.FloatData
 			} else {
 				p.bpm *= float64(te.ByteData1) / float64(te.ByteData2)
 			}
+		case releaseLenEvent:
+			vcs.releaseLen = int64(math.Round(te.FloatData * ticksPerBeat))
+		case midiRangeEvent:
+			vcs.midiMin, vcs.midiMax = te.ByteData1, te.ByteData2
+		case midiOutputEvent:
+			vcs.output = int(te.ByteData1)
+		case mt32ReverbEvent:
+			if i := p.trackOutputIndex(t); i >= 0 {
+				reverbs[i] = te
+			}
+		case midiModeEvent:
+			mode := int(te.ByteData1)
+			for i, vcs2 := range p.virtChannels {
+				if vcs2.output == vcs.output {
+					p.virtChannels[i] = newChannelState(mode, i, true)
+					p.virtChannels[i].output = vcs2.output
+				}
+			}
+			if i := p.trackOutputIndex(t); i >= 0 {
+				outModes[i] = mode
+			}
+		}
+	}
+
+	// bring outputs into line with the chased state
+	for i, out := range p.outputs {
+		if out.midiMode != outModes[i] {
+			p.setOutputMode(out, outModes[i])
+		}
+		if te := reverbs[i]; te != nil {
+			p.playEvent(te)
+		}
+	}
+	for _, t := range p.song.Tracks {
+		if vcs := p.virtChannels[t.Channel]; vcs.midiMin == vcs.midiMax {
+			t.midiChannel = vcs.midiMin
+		}
+	}
+
+	p.chasedNotes = p.chasedNotes[:0]
+	if chaseHeldNotes {
+		for i, te := range held {
+			if te != nil {
+				p.chasedNotes = append(p.chasedNotes, te)
+				if bends[i] != nil {
+					p.chasedNotes = append(p.chasedNotes, bends[i])
+				}
+			}
+		}
+	}
+}
+
+// restart notes that were held at the start tick, with their latest bends,
+// unless they end there anyway
+func (p *player) resumeChasedNotes(tick int64) {
+	for _, te := range p.chasedNotes {
+		t := p.song.Tracks[te.track]
+		if te2 := t.getEventAtTick(tick); te2 != nil && (te2.Type == noteOnEvent ||
+			te2.Type == drumNoteOnEvent || te2.Type == noteOffEvent) {
+			continue
 		}
+		if p.ignoreMute || p.song.trackAudible(t) {
+			te = te.clone()
+			te.Tick = tick
+			p.playEvent(te)
+		}
+	}
+	p.chasedNotes = p.chasedNotes[:0]
+}
+
+// return the index of the output a track plays on, or -1 if there are none
+func (p *player) trackOutputIndex(t *track) int {
+	i := p.virtChannels[t.Channel].output
+	if i >= len(p.outputs) {
+		i = len(p.outputs) - 1
+	}
+	return i
+}
+
+// reset an output for a MIDI mode
+func (p *player) setOutputMode(out *midiOutput, mode int) {
+	out.midiMode = mode
+	sendSystemOn(out.writer, mode)
+	for i := range out.channels {
+		out.channels[i] = newChannelState(mode, i, false)
 	}
+	out.sendPitchBendRPN(uint8(getBendSemitones(mode)), 0)
 }
 
 // send a stop signal to the player, waiting if await is true
@@ -638,6 +1078,7 @@ type channelState struct {
 	midiMax     uint8 // ^
 	output      int   // device index
 	midiMode    int
+	keyNoteOff  [128]int64 // like lastNoteOff, but per key; used by MTS modes
 }
 
 var (
@@ -674,10 +1115,43 @@ func newChannelState(midiMode, index int, virtual bool) *channelState {
 	case modeMPE:
 		cs.pressure = 64
 		cs.controllers[ccTimbre] = 64
+	case modeMTS, modeMTSNonRealTime:
+		// one midi channel per virtual channel, skipping percussion
+		if virtual {
+			cs.midiMin = pinnedMidiChannel(index)
+			cs.midiMax = cs.midiMin
+		}
 	}
 	return cs
 }
 
+func isMTSMode(midiMode int) bool {
+	return midiMode == modeMTS || midiMode == modeMTSNonRealTime
+}
+
+// return true if the writer gives each note its own pitch, so that notes can
+// be played as in MTS modes without retuning
+func hasPerNotePitch(wr writer.ChannelWriter) bool {
+	switch wr.(type) {
+	case *umpWriter, *oscWriter:
+		return true
+	}
+	return false
+}
+
+// return the midi channel used by a virtual channel when each virtual channel
+// gets its own, skipping percussion. there are only 15 other channels, so the
+// last two virtual channels share the last midi channel.
+func pinnedMidiChannel(index int) uint8 {
+	switch {
+	case index < percussionChannelIndex:
+		return uint8(index)
+	case index < numVirtualChannels-1:
+		return uint8(index + 1)
+	}
+	return numMidiChannels - 1
+}
+
 func (cs *channelState) isPercussionChannel() bool {
 	return cs.midiMin == percussionChannelIndex && cs.midiMax == percussionChannelIndex
 }
@@ -704,6 +1178,30 @@ func pickInactiveChannel(a []*channelState, min, max uint8, midiMode int) (uint8
 	return bestIndex, bestScore == int64(math.MaxInt64)
 }
 
+// return the key nearest to a pitch which has had no active note since before
+// tick, or failing that, the key nearest to the pitch that has no active note;
+// return true if voice was stolen. keyNoteOff is per channel or per output.
+func pickInactiveKey(keyNoteOff *[128]int64, p float64, tick int64) (uint8, bool) {
+	nearest := int(math.Round(math.Max(0, math.Min(127, p))))
+	fallback := -1
+	for d := 0; d < len(keyNoteOff); d++ {
+		for _, key := range []int{nearest - d, nearest + d} {
+			if key < 0 || key >= len(keyNoteOff) || keyNoteOff[key] == -1 {
+				continue
+			}
+			if keyNoteOff[key] <= tick {
+				return uint8(key), false
+			} else if fallback == -1 {
+				fallback = key
+			}
+		}
+	}
+	if fallback != -1 {
+		return uint8(fallback), false
+	}
+	return uint8(nearest), true
+}
+
 // clamp x between min and max inclusive
 func clamp(x, min, max uint8) uint8 {
 	if x < min {
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gomidi/midi/writer"
+)
+
+func TestMtsFrequencyData(t *testing.T) {
+	semitone, fraction := mtsFrequencyData(60)
+	assert.Equal(t, []interface{}{uint8(60), uint16(0)}, []interface{}{semitone, fraction})
+	semitone, fraction = mtsFrequencyData(60.5)
+	assert.Equal(t, []interface{}{uint8(60), uint16(0x2000)}, []interface{}{semitone, fraction})
+	semitone, fraction = mtsFrequencyData(60.99999)
+	assert.Equal(t, []interface{}{uint8(61), uint16(0)}, []interface{}{semitone, fraction})
+}
+
+func TestPinnedMidiChannel(t *testing.T) {
+	var channels []uint8
+	for i := 0; i < numVirtualChannels; i++ {
+		channels = append(channels, pinnedMidiChannel(i))
+	}
+	assert.Equal(t, []uint8{0, 1, 2, 3, 4, 5, 6, 7, 8, 10, 11, 12, 13, 14, 15, 15}, channels)
+}
+
+func TestPickInactiveKey(t *testing.T) {
+	cs := newChannelState(modeMTS, 0, false)
+	key, stolen := pickInactiveKey(&cs.keyNoteOff, 60.4, 0)
+	assert.Equal(t, uint8(60), key)
+	assert.False(t, stolen)
+	cs.keyNoteOff[60] = -1
+	key, _ = pickInactiveKey(&cs.keyNoteOff, 60.4, 0)
+	assert.Equal(t, uint8(59), key)
+	cs.keyNoteOff[59] = 100
+	key, _ = pickInactiveKey(&cs.keyNoteOff, 60.4, 0)
+	assert.Equal(t, uint8(61), key)
+	for i := range cs.keyNoteOff {
+		cs.keyNoteOff[i] = -1
+	}
+	key, stolen = pickInactiveKey(&cs.keyNoteOff, 60.4, 0)
+	assert.Equal(t, uint8(60), key)
+	assert.True(t, stolen)
+}
+
+func TestLoop(t *testing.T) {
+	s := newSong(nil)
+	s.Tracks[0].Events = []*trackEvent{
+		{Type: tempoEvent, ByteData1: 2, ByteData2: 1},
+		{Tick: 10, Type: noteOnEvent, FloatData: 60, ByteData1: 100},
+		{Tick: ticksPerBeat / 2, Type: noteOnEvent, FloatData: 62, ByteData1: 100},
+		{Tick: ticksPerBeat, Type: noteOnEvent, FloatData: 64, ByteData1: 100},
+	}
+	sr := &systemRecorder{notify: make(chan uint8)}
+	p := newPlayer(s, []writer.ChannelWriter{sr}, false)
+	go p.run()
+	p.signal <- playerSignal{typ: signalLoop, end: ticksPerBeat}
+
+	var notes []uint8
+	for len(notes) < 6 {
+		notes = append(notes, <-sr.notify)
+	}
+	go func() {
+		for range sr.notify {
+		}
+	}()
+	p.stop(true)
+	close(sr.notify)
+	assert.Equal(t, []uint8{60, 62, 60, 62, 60, 62}, notes)
+	assert.Equal(t, float64(defaultBPM*2), p.bpm) // tempo wasn't applied twice
+}
+
+func TestMuteSolo(t *testing.T) {
+	defer func(b bool) { exportMuteSolo = b }(exportMuteSolo)
+	s := newSong(nil)
+	for i, tr := range s.Tracks {
+		tr.Events = []*trackEvent{
+			{Type: noteOnEvent, FloatData: float64(60 + i), ByteData1: 100, track: i},
+			{Tick: ticksPerBeat, Type: noteOffEvent, track: i},
+		}
+	}
+	s.Tracks[0].Mute = true
+	s.Tracks[1].Solo = true
+	s.Tracks[2].Solo = true
+	play := func() []uint8 {
+		sr := &systemRecorder{}
+		p := newPlayer(s, []writer.ChannelWriter{sr}, false)
+		go p.run()
+		p.sendStopping = true
+		p.signal <- playerSignal{typ: signalStart}
+		<-p.stopping
+		return sr.notes
+	}
+
+	assert.False(t, s.trackAudible(s.Tracks[0]))
+	assert.True(t, s.trackAudible(s.Tracks[1]))
+	assert.False(t, s.trackAudible(s.Tracks[3]))
+	exportMuteSolo = true
+	assert.ElementsMatch(t, []uint8{61, 62}, play())
+	exportMuteSolo = false
+	assert.ElementsMatch(t, []uint8{60, 61, 62, 63}, play())
+}
+
+func TestChase(t *testing.T) {
+	s := newSong(nil)
+	s.Tracks[0].Events = []*trackEvent{
+		{Type: midiModeEvent, ByteData1: modeGS},
+		{Tick: 10, Type: noteOnEvent, FloatData: 60, ByteData1: 100},
+		{Tick: 20, Type: pitchBendEvent, FloatData: 60.5},
+		{Tick: 30, Type: keyPressureEvent, ByteData1: 40},
+		{Tick: ticksPerBeat * 2, Type: noteOffEvent},
+	}
+	s.Tracks[1].Channel = 1
+	s.Tracks[1].Events = []*trackEvent{
+		{Type: releaseLenEvent, FloatData: 0.5},
+		{Tick: 10, Type: midiRangeEvent, ByteData1: 3, ByteData2: 3},
+		{Tick: 20, Type: channelPressureEvent, ByteData1: 50},
+		{Tick: 30, Type: drumNoteOnEvent, ByteData1: 36, ByteData2: 100},
+		{Tick: ticksPerBeat, Type: noteOnEvent, FloatData: 64, ByteData1: 100},
+	}
+	for i, tr := range s.Tracks {
+		for _, te := range tr.Events {
+			te.track = i
+		}
+	}
+	sr := &systemRecorder{}
+	p := newPlayer(s, []writer.ChannelWriter{sr}, false)
+	p.determineVirtualChannelStates(ticksPerBeat)
+
+	assert.Equal(t, modeGS, p.outputs[0].midiMode)
+	assert.Equal(t, []byte{0xf0, 0x41, 0x10, 0x42, 0x12, 0x40, 0x00, 0x7f, 0x00, 0x41, 0xf7},
+		sr.messages[0]) // GS system on
+	vcs := p.virtChannels[1]
+	assert.Equal(t, modeGS, vcs.midiMode)
+	assert.Equal(t, int64(ticksPerBeat/2), vcs.releaseLen)
+	assert.Equal(t, uint8(3), vcs.midiMin)
+	assert.Equal(t, uint8(50), vcs.pressure)
+	assert.Equal(t, uint8(3), s.Tracks[1].midiChannel)
+	assert.Equal(t, uint8(40), s.Tracks[0].pressure)
+
+	// the held note resumes with its bend; the drum note doesn't
+	p.resumeChasedNotes(ticksPerBeat)
+	assert.Equal(t, []uint8{60}, sr.notes)
+	assert.Equal(t, uint8(60), s.Tracks[0].activeNote)
+	assert.Equal(t, int16(8192/getBendSemitones(modeGS)/2), p.virtChannels[0].bend)
+}
+
+func TestMTSKeysAcrossChannels(t *testing.T) {
+	// tunings are shared by all channels, so a key can't sound on two at once
+	s := newSong(nil)
+	s.MidiMode = modeMTS
+	s.Tracks = s.Tracks[:2]
+	for i, tr := range s.Tracks {
+		tr.Channel = uint8(i)
+		tr.Events = []*trackEvent{
+			{Type: noteOnEvent, FloatData: 60.25, ByteData1: 100, track: i},
+			{Tick: ticksPerBeat, Type: noteOffEvent, track: i},
+		}
+	}
+	sr := &systemRecorder{}
+	p := newPlayer(s, []writer.ChannelWriter{sr}, false)
+	go p.run()
+	p.sendStopping = true
+	p.signal <- playerSignal{typ: signalStart}
+	<-p.stopping
+	if assert.Len(t, sr.notes, 2) {
+		assert.NotEqual(t, sr.notes[0], sr.notes[1])
+	}
+	assert.Equal(t, 0, p.polyErrCount)
+}
@@ -0,0 +1,167 @@
+package main
+
+// notes and controllers played in via MIDI input during playback, waiting to
+// be written to the song when playback stops
+type recording struct {
+	events   []*trackEvent
+	lastTick int64 // most recent play position seen
+
+	// most recent event for each controller on each track, for thinning
+	controls map[recordControlKey]*trackEvent
+}
+
+// identifies a continuous stream of recorded events
+type recordControlKey struct {
+	track      int
+	typ        trackEventType
+	controller uint8
+}
+
+// return the key of a recorded controller, pitch bend, or pressure event
+func controlKey(te *trackEvent) recordControlKey {
+	key := recordControlKey{track: te.track, typ: te.Type}
+	if te.Type == controllerEvent {
+		key.controller = te.ByteData1
+	}
+	return key
+}
+
+// return the tick that an event played at a play position should go at
+func (pe *patternEditor) recordTick(tick int64) int64 {
+	if pe.recordQuantize {
+		return pe.roundTickToDivision(tick)
+	}
+	return tick
+}
+
+// add an event to the current recording, starting one if needed. te.track
+// must already be set.
+func (pe *patternEditor) recordEvent(te *trackEvent, tick int64) {
+	if pe.recording == nil {
+		pe.recording = &recording{controls: make(map[recordControlKey]*trackEvent)}
+	}
+	rec := pe.recording
+	te = te.clone()
+	te.Tick = pe.recordTick(tick)
+	switch te.Type {
+	case noteOnEvent, drumNoteOnEvent, noteOffEvent:
+		rec.addNote(te, pe.recordStep())
+	default:
+		rec.addControl(te)
+	}
+}
+
+// add a note on or note off to the recording
+func (rec *recording) addNote(te *trackEvent, step int64) {
+	if i := rec.eventIndex(te.track, te.Tick); i >= 0 {
+		if prev := rec.events[i].Type; te.Type == noteOffEvent &&
+			(prev == noteOnEvent || prev == drumNoteOnEvent) {
+			// don't let a short note cancel itself out
+			te.Tick += step
+			if rec.eventIndex(te.track, te.Tick) >= 0 {
+				return // the next note already ends this one
+			}
+		} else {
+			rec.events = append(rec.events[:i], rec.events[i+1:]...)
+		}
+	}
+	rec.events = append(rec.events, te)
+}
+
+// add a controller, pitch bend, or pressure event to the recording. events
+// closer together than the thinning interval update the previous event
+// instead, so that continuous streams don't flood the pattern.
+func (rec *recording) addControl(te *trackEvent) {
+	key := controlKey(te)
+	if prev := rec.controls[key]; prev != nil && recordThinning > 0 &&
+		te.Tick-prev.Tick < ticksPerBeat/int64(recordThinning) && rec.contains(prev) {
+		prev.ByteData1, prev.ByteData2, prev.FloatData = te.ByteData1, te.ByteData2, te.FloatData
+		prev.uiString = te.uiString
+		return
+	}
+	// other events keep their place; find the next free tick
+	for i := rec.eventIndex(te.track, te.Tick); i >= 0; i = rec.eventIndex(te.track, te.Tick) {
+		if controlKey(rec.events[i]) == key {
+			rec.events = append(rec.events[:i], rec.events[i+1:]...)
+			break
+		}
+		te.Tick++
+	}
+	rec.events = append(rec.events, te)
+	rec.controls[key] = te
+}
+
+// return true if an event is still part of the recording
+func (rec *recording) contains(te *trackEvent) bool {
+	for _, te2 := range rec.events {
+		if te2 == te {
+			return true
+		}
+	}
+	return false
+}
+
+// return the index of the recorded event at a position, or -1 if none
+func (rec *recording) eventIndex(track int, tick int64) int {
+	for i, te := range rec.events {
+		if te.track == track && te.Tick == tick {
+			return i
+		}
+	}
+	return -1
+}
+
+// return the smallest distance between recorded events
+func (pe *patternEditor) recordStep() int64 {
+	if pe.recordQuantize {
+		return ticksPerBeat / int64(pe.division)
+	}
+	return 1
+}
+
+// update the recording with the player's position. when playback stops, the
+// recording is written to the song as one edit action.
+func (pe *patternEditor) updateRecording(tick int64, playing bool) {
+	if rec := pe.recording; rec != nil {
+		if playing {
+			rec.lastTick = tick
+		} else {
+			pe.recording = nil
+			pe.commitRecording(rec)
+		}
+	}
+}
+
+// write recorded events to the song, ending any notes still held
+func (pe *patternEditor) commitRecording(rec *recording) {
+	held := make(map[int]*trackEvent)
+	for _, te := range rec.events {
+		switch te.Type {
+		case noteOffEvent:
+			delete(held, te.track)
+		case noteOnEvent, drumNoteOnEvent:
+			held[te.track] = te
+		}
+	}
+	for track, te := range held {
+		if tick := pe.recordTick(rec.lastTick); tick > te.Tick {
+			rec.addNote(newTrackEvent(&trackEvent{
+				Type:  noteOffEvent,
+				Tick:  tick,
+				track: track,
+			}, nil), pe.recordStep())
+		}
+	}
+
+	ea := &editAction{}
+	for _, te := range rec.events {
+		if te.track >= len(pe.song.Tracks) {
+			continue // track was deleted while recording
+		}
+		if te2 := pe.song.Tracks[te.track].getEventAtTick(te.Tick); te2 != nil {
+			ea.beforeEvents = append(ea.beforeEvents, te2.clone())
+		}
+		ea.afterEvents = append(ea.afterEvents, te)
+	}
+	pe.doNewEditAction(ea)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecording(t *testing.T) {
+	s := newSong(nil)
+	s.Tracks = append(s.Tracks, newTrack(0, 1))
+	s.Tracks[1].Events = []*trackEvent{{Tick: ticksPerBeat, Type: noteOffEvent, track: 1}}
+	pe := &patternEditor{song: s, division: 4, historyIndex: -1, historySizeLimit: 1e6,
+		recordQuantize: true}
+	step := int64(ticksPerBeat / 4)
+
+	// chord, with one short note and one held past the end of playback
+	pe.recordEvent(&trackEvent{Type: noteOnEvent, FloatData: 60, track: 0}, 10)
+	pe.recordEvent(&trackEvent{Type: noteOnEvent, FloatData: 64, track: 1}, step-10)
+	pe.recordEvent(&trackEvent{Type: noteOffEvent, track: 0}, 20)
+	pe.updateRecording(ticksPerBeat*2, true)
+	assert.Empty(t, s.Tracks[0].Events)
+	pe.updateRecording(ticksPerBeat*2, false)
+	assert.Nil(t, pe.recording)
+
+	ticks := func(tr *track) []int64 {
+		var a []int64
+		for _, te := range tr.Events {
+			a = append(a, te.Tick)
+		}
+		return a
+	}
+	assert.Equal(t, []int64{0, step}, ticks(s.Tracks[0]))
+	assert.ElementsMatch(t, []int64{ticksPerBeat, step, ticksPerBeat * 2}, ticks(s.Tracks[1]))
+
+	// one undo removes the whole take
+	assert.Nil(t, pe.undo())
+	assert.Empty(t, s.Tracks[0].Events)
+	assert.Equal(t, []int64{ticksPerBeat}, ticks(s.Tracks[1]))
+}
+
+func TestRecordingControls(t *testing.T) {
+	defer func(n int) { recordThinning = n }(recordThinning)
+	recordThinning = 4
+	s := newSong(nil)
+	pe := &patternEditor{song: s, division: 4, historyIndex: -1, historySizeLimit: 1e6}
+
+	pe.recordEvent(&trackEvent{Type: noteOnEvent, FloatData: 60}, 0)
+	for tick := int64(0); tick < ticksPerBeat; tick += 10 {
+		pe.recordEvent(&trackEvent{Type: pitchBendEvent, FloatData: 60 + float64(tick)/ticksPerBeat}, tick)
+		pe.recordEvent(&trackEvent{Type: controllerEvent, ByteData1: 1, ByteData2: uint8(tick / 10)}, tick)
+	}
+	pe.updateRecording(ticksPerBeat, false)
+
+	var bends, ccs []*trackEvent
+	for _, te := range s.Tracks[0].Events {
+		switch te.Type {
+		case pitchBendEvent:
+			bends = append(bends, te)
+		case controllerEvent:
+			ccs = append(ccs, te)
+		}
+	}
+	// thinned to one event per quarter beat, keeping the latest values
+	if assert.Len(t, bends, 4) {
+		assert.Equal(t, int64(1), bends[0].Tick) // moved past the note
+		assert.Equal(t, 60.25, bends[0].FloatData)
+	}
+	if assert.Len(t, ccs, 4) {
+		assert.Equal(t, int64(2), ccs[0].Tick)
+		assert.Equal(t, uint8(95), ccs[3].ByteData2)
+	}
+}
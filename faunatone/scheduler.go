@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// the shortest sleep while waiting for a target time; see waitUntil
+	schedulerMinSleep = 100 * time.Microsecond
+
+	// how long before its target time the player processes a playback step.
+	// the messages it writes wait in a sendQueue until they're due, so the
+	// time spent processing doesn't make them late.
+	schedulerLookahead = 5 * time.Millisecond
+)
+
+// a stretch of constant tempo
+type tempoSegment struct {
+	tick   int64
+	offset time.Duration // time of tick since the start of the map
+	bpm    float64
+}
+
+// map of ticks to times since playback started, built from the tempo events
+// as they're played. times are computed from the start of the map rather
+// than accumulated step by step, so rounding errors don't build up.
+type tempoMap struct {
+	segments []tempoSegment
+}
+
+// create a tempo map starting at a tick
+func newTempoMap(tick int64, bpm float64) *tempoMap {
+	return &tempoMap{segments: []tempoSegment{{tick: tick, bpm: bpm}}}
+}
+
+// return the tempo at the end of the map
+func (tm *tempoMap) bpm() float64 {
+	return tm.segments[len(tm.segments)-1].bpm
+}
+
+// change the tempo from a tick onward
+func (tm *tempoMap) setTempo(tick int64, bpm float64) {
+	offset := tm.timeAt(tick)
+	i := len(tm.segments)
+	for i > 0 && tm.segments[i-1].tick >= tick {
+		i--
+	}
+	tm.segments = append(tm.segments[:i], tempoSegment{tick, offset, bpm})
+}
+
+// return the segment that a tick is in
+func (tm *tempoMap) segment(tick int64) tempoSegment {
+	for i := len(tm.segments) - 1; i > 0; i-- {
+		if tm.segments[i].tick <= tick {
+			return tm.segments[i]
+		}
+	}
+	return tm.segments[0]
+}
+
+// return the time of a tick since the start of the map
+func (tm *tempoMap) timeAt(tick int64) time.Duration {
+	seg := tm.segment(tick)
+	minutes := float64(tick-seg.tick) / ticksPerBeat / seg.bpm
+	return seg.offset + time.Duration(math.Round(minutes*float64(time.Minute)))
+}
+
+// sleep until a time. each sleep covers half of the time left, so that any
+// overshoot is small compared to it, until the rest is too short to split.
+func waitUntil(t time.Time) {
+	for d := time.Until(t); d > 0; d = time.Until(t) {
+		if d > schedulerMinSleep*2 {
+			d /= 2
+		}
+		time.Sleep(d)
+	}
+}
+
+// a send waiting in a sendQueue
+type queuedSend struct {
+	at   time.Time // zero to send as soon as possible
+	send func()
+}
+
+// queue of sends that its own goroutine makes at their target times, in the
+// order they were queued
+type sendQueue struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	at      time.Time // target time for sends queued from now on
+	pending []queuedSend
+	timing  *timingStats
+}
+
+// create a send queue that records how late its timed sends are
+func newSendQueue(timing *timingStats) *sendQueue {
+	q := &sendQueue{timing: timing}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// set the target time for the following sends, or zero to send them as soon
+// as possible
+func (q *sendQueue) setTime(t time.Time) {
+	q.mutex.Lock()
+	q.at = t
+	q.mutex.Unlock()
+}
+
+// queue a send for the current target time
+func (q *sendQueue) send(f func()) {
+	q.mutex.Lock()
+	q.pending = append(q.pending, queuedSend{q.at, f})
+	q.mutex.Unlock()
+	q.cond.Signal()
+}
+
+// make queued sends when they're due. this never returns.
+func (q *sendQueue) run() {
+	for {
+		q.mutex.Lock()
+		for len(q.pending) == 0 {
+			q.cond.Wait()
+		}
+		qs := q.pending[0]
+		q.pending[0] = queuedSend{}
+		q.pending = q.pending[1:]
+		q.mutex.Unlock()
+		if !qs.at.IsZero() {
+			waitUntil(qs.at)
+			q.timing.add(time.Since(qs.at))
+		}
+		qs.send()
+	}
+}
+
+// how late timed messages have been sent, relative to their target times
+type timingStats struct {
+	mutex sync.Mutex
+	count int
+	total time.Duration
+	max   time.Duration
+	last  time.Duration
+}
+
+// clear the statistics for a new playback
+func (ts *timingStats) reset() {
+	ts.mutex.Lock()
+	ts.count, ts.total, ts.max, ts.last = 0, 0, 0, 0
+	ts.mutex.Unlock()
+}
+
+// record how late a message was
+func (ts *timingStats) add(late time.Duration) {
+	ts.mutex.Lock()
+	ts.count++
+	ts.total += late
+	if late > ts.max {
+		ts.max = late
+	}
+	ts.last = late
+	ts.mutex.Unlock()
+}
+
+// return a status string for the statistics, or "" if there are none. this is
+// safe to call from other goroutines.
+func (ts *timingStats) String() string {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if ts.count == 0 {
+		return ""
+	}
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return fmt.Sprintf("Late: %.1f ms (avg %.1f, max %.1f)",
+		ms(ts.last), ms(ts.total/time.Duration(ts.count)), ms(ts.max))
+}
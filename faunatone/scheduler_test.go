@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gomidi/midi/writer"
+)
+
+func TestTempoMap(t *testing.T) {
+	tm := newTempoMap(ticksPerBeat, 120)
+	assert.Equal(t, time.Duration(0), tm.timeAt(ticksPerBeat))
+	assert.Equal(t, time.Second, tm.timeAt(ticksPerBeat*3))
+	tm.setTempo(ticksPerBeat*3, 60)
+	assert.Equal(t, 60.0, tm.bpm())
+	assert.Equal(t, time.Second*3, tm.timeAt(ticksPerBeat*5))
+
+	// replacing a tempo change at the same tick
+	tm.setTempo(ticksPerBeat*3, 240)
+	assert.Equal(t, 2, len(tm.segments))
+	assert.Equal(t, time.Second*3/2, tm.timeAt(ticksPerBeat*5))
+
+	// times are exact after a long time at a tempo that doesn't divide evenly
+	tm = newTempoMap(0, 137)
+	assert.Equal(t, time.Hour, tm.timeAt(ticksPerBeat*137*60))
+}
+
+func TestWaitUntil(t *testing.T) {
+	target := time.Now().Add(time.Millisecond * 5)
+	waitUntil(target)
+	assert.False(t, time.Now().Before(target))
+}
+
+func TestSendQueue(t *testing.T) {
+	var ts timingStats
+	q := newSendQueue(&ts)
+	go q.run()
+	sent := make(chan int, 2)
+	target := time.Now().Add(time.Millisecond * 5)
+	q.setTime(target)
+	q.send(func() { sent <- 1 })
+	q.setTime(time.Time{})
+	q.send(func() { sent <- 2 }) // waits its turn
+	assert.Equal(t, 1, <-sent)
+	assert.False(t, time.Now().Before(target))
+	assert.Equal(t, 2, <-sent)
+	assert.Equal(t, 1, ts.count) // only timed sends count
+}
+
+// writer that reports when each OSC packet is written
+type timedConn chan timedPacket
+
+type timedPacket struct {
+	addr string
+	time time.Time
+}
+
+func (tc timedConn) Write(b []byte) (int, error) {
+	addr, _ := decodeOSCMessage(b)
+	tc <- timedPacket{addr, time.Now()}
+	return len(b), nil
+}
+
+func TestRealtimeLookahead(t *testing.T) {
+	s := newSong(nil)
+	s.Tracks[0].Events = []*trackEvent{
+		{Type: noteOnEvent, FloatData: 60, ByteData1: 100},
+		{Tick: ticksPerBeat / 32, Type: noteOffEvent},
+	}
+	conn := make(timedConn, 64)
+	p := newPlayer(s, []writer.ChannelWriter{newOSCWriter(conn)}, true)
+	go p.run()
+	start := time.Now()
+	p.signal <- playerSignal{typ: signalStart}
+
+	// the note off is processed early but sent on time
+	pkt := <-conn
+	for pkt.addr != "/note_off" {
+		pkt = <-conn
+	}
+	assert.True(t, pkt.time.Sub(start) >= time.Minute/defaultBPM/32)
+	assert.NotEqual(t, "", p.timing.String())
+}
+
+func TestTimingStats(t *testing.T) {
+	var ts timingStats
+	assert.Equal(t, "", ts.String())
+	ts.add(time.Millisecond)
+	ts.add(time.Millisecond * 3)
+	ts.add(time.Millisecond * 2)
+	assert.Equal(t, "Late: 2.0 ms (avg 2.0, max 3.0)", ts.String())
+	ts.reset()
+	assert.Equal(t, "", ts.String())
+}
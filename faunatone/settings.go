@@ -12,6 +12,15 @@ var (
 )
 
 type settings struct {
+	AudioAttack        int
+	AudioBitDepth      int
+	AudioDecay         int
+	AudioRelease       int
+	AudioSampleRate    int
+	AudioSoundFont     string
+	AudioSustain       int
+	AudioWaveform      string
+	ChaseHeldNotes     bool
 	ColorBeat          uint32
 	ColorBg1           uint32
 	ColorBg2           uint32
@@ -19,15 +28,20 @@ type settings struct {
 	ColorPlayPos       uint32
 	ColorSelect        uint32
 	DefaultKeymap      string
+	ExportMuteSolo     bool
 	PercussionKeymap   string
 	Font               string
 	FontSize           int
 	MessageDuration    int
-	MidiInPortNumber   int
+	MidiClockOutputs   string
+	MidiInPortNumber   string
+	MidiInputBendRange int
 	MidiInputChannels  string
 	MidiOutPortNumber  string
 	OffDivisionAlpha   int
+	OscOutputAddress   string
 	PitchBendSemitones int
+	RecordThinning     int
 	ShiftScrollMult    int
 	UndoBufferSize     int
 	WindowHeight       int
@@ -90,15 +104,20 @@ func (s *settings) applyRecords(records [][]string, warn func(string)) {
 	}
 }
 
-// parse and return midi out port numbers
-func (s *settings) parsedMidiOutPortNumbers() ([]int, error) {
-	vs := []int{}
-	for _, s := range strings.Split(s.MidiOutPortNumber, " ") {
-		if i, err := strconv.Atoi(s); err == nil {
-			vs = append(vs, i)
-		} else {
-			return nil, err
+// return the indices of MIDI outputs that send clock
+func (s *settings) midiClockOutputs() ([]int, error) {
+	var a []int
+	for _, field := range strings.Fields(s.MidiClockOutputs) {
+		i, err := strconv.Atoi(field)
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("invalid MidiClockOutputs setting: %q", s.MidiClockOutputs)
 		}
+		a = append(a, i)
 	}
-	return vs, nil
+	return a, nil
+}
+
+// return OSC output addresses
+func (s *settings) oscOutputAddresses() []string {
+	return strings.Fields(s.OscOutputAddress)
 }
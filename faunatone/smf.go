@@ -0,0 +1,589 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/midimessage/channel"
+	"gitlab.com/gomidi/midi/midimessage/meta"
+	"gitlab.com/gomidi/midi/reader"
+	"gitlab.com/gomidi/midi/smf"
+	"gitlab.com/gomidi/midi/writer"
+)
+
+const (
+	defaultImportBendSemitones = 2 // GM default pitch bend sensitivity
+
+	rpnDataMSB = 6
+	rpnDataLSB = 38
+	nrpnLSB    = 98
+	nrpnMSB    = 99
+	rpnLSB     = 100
+	rpnMSB     = 101
+)
+
+// a message read from an SMF, with its position converted to song ticks
+type smfMessage struct {
+	tick int64
+	msg  midi.Message
+}
+
+// state of a MIDI channel during import
+type smfChannelState struct {
+	bend       int16
+	bendRange  float64 // in semitones
+	bankMSB    uint8
+	bankLSB    uint8
+	rpn        [2]uint8 // MSB, LSB of selected RPN
+	tracks     []*smfImportTrack
+	percussion bool
+}
+
+// a song track being built during import
+type smfImportTrack struct {
+	t         *track
+	events    map[int64]*trackEvent // events by tick
+	activeKey int                   // -1 if no note is active
+}
+
+// return true if the track has no event at the tick
+func (it *smfImportTrack) free(tick int64) bool {
+	return it.events[tick] == nil
+}
+
+// add an event to the track
+func (it *smfImportTrack) add(te *trackEvent) {
+	it.events[te.Tick] = te
+	it.t.Events = append(it.t.Events, te)
+}
+
+// remove the event at a tick from the track, if any
+func (it *smfImportTrack) remove(tick int64) {
+	if te := it.events[tick]; te != nil {
+		delete(it.events, tick)
+		for i, te2 := range it.t.Events {
+			if te2 == te {
+				it.t.Events = append(it.t.Events[:i], it.t.Events[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// type that converts a series of MIDI messages into song tracks
+type smfImporter struct {
+	channels  [numMidiChannels]*smfChannelState
+	metaTrack *smfImportTrack
+	title     string
+}
+
+// import a Standard MIDI File; if successful, the current song data is
+// replaced. the current keymap is kept.
+func (s *song) importSMF(path string) error {
+	var msgs []*smfMessage
+	rd := reader.New(reader.NoLogger(),
+		reader.Each(func(pos *reader.Position, msg midi.Message) {
+			if pos != nil {
+				msgs = append(msgs, &smfMessage{
+					tick: int64(pos.AbsoluteTicks),
+					msg:  msg,
+				})
+			}
+		}),
+	)
+	if err := reader.ReadSMFFile(rd, path); err != nil {
+		return err
+	}
+	header := rd.Header()
+	if header.Format == smf.SMF2 {
+		return fmt.Errorf("type 2 MIDI files are not supported")
+	}
+	resolution, ok := header.TimeFormat.(smf.MetricTicks)
+	if !ok || resolution.Resolution() == 0 {
+		return fmt.Errorf("SMPTE time format is not supported")
+	}
+	for _, m := range msgs {
+		m.tick = int64(math.Round(float64(m.tick*ticksPerBeat) / float64(resolution.Resolution())))
+	}
+	// messages in type 1 files are read track by track
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].tick < msgs[j].tick
+	})
+
+	imp := newSMFImporter()
+	for _, m := range msgs {
+		imp.process(m)
+	}
+	if len(msgs) > 0 {
+		imp.endNotes(msgs[len(msgs)-1].tick)
+	}
+	newSong := newSong(s.Keymap)
+	newSong.Title = imp.title
+	newSong.Tracks = imp.tracks()
+	for i, t := range newSong.Tracks {
+		t.index = i
+		for _, te := range t.Events {
+			te.track = i
+			te.setUiString(newSong.Keymap)
+		}
+	}
+	*s = *newSong
+	return nil
+}
+
+// initialize a new SMF importer
+func newSMFImporter() *smfImporter {
+	imp := &smfImporter{}
+	for i := range imp.channels {
+		imp.channels[i] = &smfChannelState{
+			bendRange:  defaultImportBendSemitones,
+			rpn:        [2]uint8{0x7f, 0x7f},
+			percussion: i == percussionChannelIndex,
+		}
+	}
+	return imp
+}
+
+// convert a single MIDI message into track events
+func (imp *smfImporter) process(m *smfMessage) {
+	switch msg := m.msg.(type) {
+	case channel.NoteOn:
+		if msg.Velocity() == 0 {
+			imp.noteOff(m.tick, msg.Channel(), msg.Key())
+		} else {
+			imp.noteOn(m.tick, msg.Channel(), msg.Key(), msg.Velocity())
+		}
+	case channel.NoteOff:
+		imp.noteOff(m.tick, msg.Channel(), msg.Key())
+	case channel.NoteOffVelocity:
+		imp.noteOff(m.tick, msg.Channel(), msg.Key())
+	case channel.ControlChange:
+		imp.controlChange(m.tick, msg.Channel(), msg.Controller(), msg.Value())
+	case channel.ProgramChange:
+		cs := imp.channels[msg.Channel()]
+		imp.placeChannelEvent(msg.Channel(), &trackEvent{
+			Tick:      m.tick,
+			Type:      programEvent,
+			ByteData1: msg.Program(),
+			ByteData2: cs.bankMSB,
+			ByteData3: cs.bankLSB,
+		})
+	case channel.Pitchbend:
+		imp.pitchBend(m.tick, msg.Channel(), msg.Value())
+	case channel.Aftertouch:
+		imp.placeChannelEvent(msg.Channel(), &trackEvent{
+			Tick:      m.tick,
+			Type:      channelPressureEvent,
+			ByteData1: msg.Pressure(),
+		})
+	case channel.PolyAftertouch:
+		cs := imp.channels[msg.Channel()]
+		for _, it := range cs.tracks {
+			if it.activeKey == int(msg.Key()) {
+				imp.placeTrackEvent(it, &trackEvent{
+					Tick:      m.tick,
+					Type:      keyPressureEvent,
+					ByteData1: msg.Pressure(),
+				})
+				break
+			}
+		}
+	case meta.Tempo:
+		imp.placeMetaEvent(&trackEvent{
+			Tick:      m.tick,
+			Type:      tempoEvent,
+			FloatData: msg.FractionalBPM(),
+		})
+	case meta.Text:
+		imp.placeTextEvent(m.tick, 1, msg.Text())
+	case meta.Copyright:
+		imp.placeTextEvent(m.tick, 2, msg.Text())
+	case meta.TrackSequenceName:
+		if imp.title == "" {
+			imp.title = msg.Text()
+		}
+		imp.placeTextEvent(m.tick, 3, msg.Text())
+	case meta.Instrument:
+		imp.placeTextEvent(m.tick, 4, msg.Text())
+	case meta.Lyric:
+		imp.placeTextEvent(m.tick, 5, msg.Text())
+	case meta.Marker:
+		imp.placeTextEvent(m.tick, 6, msg.Text())
+	case meta.Cuepoint:
+		imp.placeTextEvent(m.tick, 7, msg.Text())
+	case meta.Program:
+		imp.placeTextEvent(m.tick, 8, msg.Text())
+	case meta.Device:
+		imp.placeTextEvent(m.tick, 9, msg.Text())
+	}
+}
+
+// return the pitch of a key on a channel, accounting for pitch bend
+func (imp *smfImporter) pitch(ch, key uint8) float64 {
+	cs := imp.channels[ch]
+	return float64(key) + float64(cs.bend)*cs.bendRange/8192
+}
+
+// import a note on message
+func (imp *smfImporter) noteOn(tick int64, ch, key, vel uint8) {
+	cs := imp.channels[ch]
+	te := &trackEvent{Tick: tick}
+	if cs.percussion {
+		te.Type, te.ByteData1, te.ByteData2 = drumNoteOnEvent, key, vel
+	} else {
+		te.Type, te.FloatData, te.ByteData1 = noteOnEvent, imp.pitch(ch, key), vel
+	}
+	// a note on implicitly ends the previous note in a track, so a note off
+	// at the same tick can be replaced
+	var it *smfImportTrack
+	for _, it2 := range cs.tracks {
+		if it2.activeKey == -1 {
+			if te := it2.events[tick]; te != nil && te.Type == noteOffEvent {
+				it = it2
+				break
+			} else if te == nil && it == nil {
+				it = it2
+			}
+		}
+	}
+	if it == nil {
+		it = imp.newTrack(ch)
+	}
+	it.remove(tick)
+	it.add(te)
+	it.activeKey = int(key)
+}
+
+// import a note off message
+func (imp *smfImporter) noteOff(tick int64, ch, key uint8) {
+	for _, it := range imp.channels[ch].tracks {
+		if it.activeKey == int(key) {
+			imp.placeTrackEvent(it, &trackEvent{Tick: tick, Type: noteOffEvent})
+			it.activeKey = -1
+			return
+		}
+	}
+}
+
+// turn off any notes still active at the end of the song
+func (imp *smfImporter) endNotes(tick int64) {
+	for ch, cs := range imp.channels {
+		for _, it := range cs.tracks {
+			if it.activeKey != -1 {
+				imp.noteOff(tick, uint8(ch), uint8(it.activeKey))
+			}
+		}
+	}
+}
+
+// import a control change message
+func (imp *smfImporter) controlChange(tick int64, ch, cc, value uint8) {
+	cs := imp.channels[ch]
+	switch cc {
+	case ccBankMSB:
+		cs.bankMSB = value
+	case ccBankLSB:
+		cs.bankLSB = value
+	case rpnMSB:
+		cs.rpn[0] = value
+	case rpnLSB:
+		cs.rpn[1] = value
+	case nrpnMSB, nrpnLSB:
+		cs.rpn = [2]uint8{0x7f, 0x7f}
+	case rpnDataMSB, rpnDataLSB:
+		// pitch bend sensitivity is the only RPN the player doesn't manage
+		if cs.rpn == [2]uint8{0, 0} {
+			semitones, cents := math.Modf(cs.bendRange)
+			if cc == rpnDataMSB {
+				semitones = float64(value)
+			} else {
+				cents = float64(value) / 100
+			}
+			cs.bendRange = semitones + cents
+		}
+	default:
+		imp.placeChannelEvent(ch, &trackEvent{
+			Tick:      tick,
+			Type:      controllerEvent,
+			ByteData1: cc,
+			ByteData2: value,
+		})
+	}
+}
+
+// import a pitch bend message
+func (imp *smfImporter) pitchBend(tick int64, ch uint8, value int16) {
+	cs := imp.channels[ch]
+	cs.bend = value
+	if cs.percussion {
+		return
+	}
+	for _, it := range cs.tracks {
+		if it.activeKey == -1 {
+			continue
+		}
+		pitch := imp.pitch(ch, uint8(it.activeKey))
+		// bends at the same tick as the note modify the note itself
+		if te := it.events[tick]; te != nil &&
+			(te.Type == noteOnEvent || te.Type == pitchBendEvent) {
+			te.FloatData = pitch
+		} else {
+			imp.placeTrackEvent(it, &trackEvent{
+				Tick:      tick,
+				Type:      pitchBendEvent,
+				FloatData: pitch,
+			})
+		}
+	}
+}
+
+// add a track for a MIDI channel
+func (imp *smfImporter) newTrack(ch uint8) *smfImportTrack {
+	cs := imp.channels[ch]
+	it := &smfImportTrack{
+		t:         newTrack(ch, 0),
+		events:    make(map[int64]*trackEvent),
+		activeKey: -1,
+	}
+	if cs.percussion && len(cs.tracks) == 0 {
+		// route the virtual channel directly to the percussion channel
+		it.add(&trackEvent{
+			Type:      midiRangeEvent,
+			ByteData1: percussionChannelIndex,
+			ByteData2: percussionChannelIndex,
+		})
+	}
+	cs.tracks = append(cs.tracks, it)
+	return it
+}
+
+// place an event in a specific track, delaying it until the next free tick
+// if necessary
+func (imp *smfImporter) placeTrackEvent(it *smfImportTrack, te *trackEvent) {
+	for !it.free(te.Tick) {
+		te.Tick++
+	}
+	it.add(te)
+}
+
+// place an event that affects an entire channel in any track of that channel,
+// preferring tracks without active notes
+func (imp *smfImporter) placeChannelEvent(ch uint8, te *trackEvent) {
+	cs := imp.channels[ch]
+	for _, idle := range []bool{true, false} {
+		for _, it := range cs.tracks {
+			if (it.activeKey == -1) == idle && it.free(te.Tick) {
+				it.add(te)
+				return
+			}
+		}
+	}
+	imp.newTrack(ch).add(te)
+}
+
+// place a tempo or text event in the meta track
+func (imp *smfImporter) placeMetaEvent(te *trackEvent) {
+	if imp.metaTrack == nil {
+		imp.metaTrack = &smfImportTrack{
+			t:         newTrack(0, 0),
+			events:    make(map[int64]*trackEvent),
+			activeKey: -1,
+		}
+	}
+	imp.placeTrackEvent(imp.metaTrack, te)
+}
+
+// place a text event in the meta track
+func (imp *smfImporter) placeTextEvent(tick int64, label byte, text string) {
+	imp.placeMetaEvent(&trackEvent{
+		Tick:      tick,
+		Type:      textEvent,
+		ByteData1: label,
+		TextData:  text,
+	})
+}
+
+// return the imported tracks, ordered by channel
+func (imp *smfImporter) tracks() []*track {
+	var ts []*track
+	if imp.metaTrack != nil {
+		ts = append(ts, imp.metaTrack.t)
+	}
+	for _, cs := range imp.channels {
+		for _, it := range cs.tracks {
+			ts = append(ts, it.t)
+		}
+	}
+	for _, t := range ts {
+		t.sortEvents()
+	}
+	if len(ts) == 0 {
+		ts = append(ts, newTrack(0, 0))
+	}
+	return ts
+}
+
+// ways to lay out a multi-track export
+const (
+	smfLayoutPerTrack   = iota // one MTrk per song track
+	smfLayoutPerChannel        // one MTrk per output MIDI channel
+)
+
+func smfLayoutTargets() []*tabTarget {
+	return []*tabTarget{
+		{display: "Per song track", value: fmt.Sprintf("%d", smfLayoutPerTrack)},
+		{display: "Per MIDI channel", value: fmt.Sprintf("%d", smfLayoutPerChannel)},
+	}
+}
+
+// identifies an MTrk in a multi-track export. the conductor track has output
+// -1, and messages not caused by any song track have index -1.
+type smfLane struct {
+	output int
+	index  int // song track or MIDI channel, depending on layout
+}
+
+var conductorLane = smfLane{output: -1}
+
+// a message recorded during a multi-track export
+type smfRecord struct {
+	tick int64
+	lane smfLane
+	msg  midi.Message
+}
+
+// midi writer that records messages from one output of the player, sorting
+// them into lanes
+type smfRecorder struct {
+	records *[]smfRecord
+	layout  int
+	output  int
+	channel uint8
+	track   int
+	tick    int64 // set by the player
+}
+
+func (r *smfRecorder) Channel() uint8 {
+	return r.channel
+}
+
+func (r *smfRecorder) SetChannel(ch uint8) {
+	r.channel = ch
+}
+
+func (r *smfRecorder) Write(msg midi.Message) error {
+	lane := smfLane{output: r.output, index: r.track}
+	if _, ok := msg.(meta.Message); ok {
+		lane = conductorLane
+	} else if r.layout == smfLayoutPerChannel {
+		lane.index = int(r.channel)
+		if cm, ok := msg.(channel.Message); ok {
+			lane.index = int(cm.Channel())
+		}
+	}
+	*r.records = append(*r.records, smfRecord{r.tick, lane, msg})
+	return nil
+}
+
+func (r *smfRecorder) setSourceTrack(i int) int {
+	prev := r.track
+	r.track = i
+	return prev
+}
+
+// export to a type 1 MIDI file with a conductor track for tempo and text
+// events, and one track per song track or output MIDI channel. all outputs go
+// in the same file, distinguished by MIDI port meta-events. if the polyphony
+// limit was exceeded, the file is still written and a *polyphonyError is
+// returned.
+func (s *song) exportMultitrackSMF(path string, layout int) error {
+	numOutputs := 1
+	for _, output := range s.usedOutputs() {
+		if output >= numOutputs {
+			numOutputs = output + 1
+		}
+	}
+	var records []smfRecord
+	wrs := make([]writer.ChannelWriter, numOutputs)
+	for i := range wrs {
+		wrs[i] = &smfRecorder{records: &records, layout: layout, output: i, track: -1}
+	}
+	p := newPlayer(s, wrs, false)
+	go p.run()
+	p.sendStopping = true
+	p.signal <- playerSignal{typ: signalStart}
+	<-p.stopping
+
+	// records are already in tick order, so a stable sort by lane keeps them
+	// that way within each lane
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i].lane, records[j].lane
+		return a.output < b.output || (a.output == b.output && a.index < b.index)
+	})
+	lanes := []smfLane{conductorLane}
+	for _, rec := range records {
+		if rec.lane != lanes[len(lanes)-1] {
+			lanes = append(lanes, rec.lane)
+		}
+	}
+
+	err := writer.WriteSMF(path, uint16(len(lanes)), func(wr *writer.SMF) error {
+		wr.ConsolidateNotes(false) // prevents timing issues with 0-velocity notes
+		for i, lane := range lanes {
+			wr.SetDelta(0)
+			writer.TrackSequenceName(wr, s.smfLaneName(lane, layout, numOutputs, path))
+			if lane != conductorLane && numOutputs > 1 {
+				writer.DeprecatedPort(wr, uint8(lane.output))
+			}
+			lastTick := int64(0)
+			for len(records) > 0 && records[0].lane == lane {
+				wr.SetDelta(uint32(records[0].tick - lastTick))
+				if err := wr.Write(records[0].msg); err != nil {
+					return err
+				}
+				lastTick = records[0].tick
+				records = records[1:]
+			}
+			if i < len(lanes)-1 {
+				if err := writer.EndOfTrack(wr); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if p.polyErrCount > 0 {
+		return &polyphonyError{p.polyErrCount}
+	}
+	return nil
+}
+
+// return the track name to use for a lane in a multi-track export
+func (s *song) smfLaneName(lane smfLane, layout, numOutputs int, path string) string {
+	var name string
+	switch {
+	case lane == conductorLane:
+		if s.Title != "" {
+			return s.Title
+		}
+		return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	case lane.index == -1:
+		name = "Setup"
+	case layout == smfLayoutPerChannel:
+		name = fmt.Sprintf("Channel %d", lane.index+1)
+	default:
+		name = fmt.Sprintf("Track %d (channel %d)",
+			lane.index+1, s.Tracks[lane.index].Channel+1)
+	}
+	if numOutputs > 1 {
+		name += fmt.Sprintf(" (output %d)", lane.output)
+	}
+	return name
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/midimessage/channel"
+	"gitlab.com/gomidi/midi/midimessage/meta"
+	"gitlab.com/gomidi/midi/reader"
+	"gitlab.com/gomidi/midi/writer"
+)
+
+// return all events of a type in the song
+func eventsOfType(s *song, et trackEventType) []*trackEvent {
+	var tes []*trackEvent
+	for _, t := range s.Tracks {
+		for _, te := range t.Events {
+			if te.Type == et {
+				tes = append(tes, te)
+			}
+		}
+	}
+	return tes
+}
+
+func TestImportSMF(t *testing.T) {
+	s := newSong(nil)
+	s.Tracks[0].Events = []*trackEvent{
+		{Tick: 0, Type: tempoEvent, FloatData: 90},
+		{Tick: ticksPerBeat, Type: textEvent, ByteData1: 6, TextData: "chorus"},
+	}
+	s.Tracks[1].Events = []*trackEvent{
+		{Tick: 0, Type: controllerEvent, ByteData1: 7, ByteData2: 80, track: 1},
+		{Tick: ticksPerBeat / 2, Type: programEvent, ByteData1: 5, track: 1},
+	}
+	s.Tracks[2].Events = []*trackEvent{
+		{Tick: 0, Type: noteOnEvent, FloatData: 60.5, ByteData1: 100, track: 2},
+		{Tick: ticksPerBeat, Type: pitchBendEvent, FloatData: 62, track: 2},
+		{Tick: ticksPerBeat * 2, Type: noteOffEvent, track: 2},
+	}
+	s.Tracks[3].Events = []*trackEvent{
+		{Tick: 0, Type: noteOnEvent, FloatData: 64, ByteData1: 90, track: 3},
+		{Tick: ticksPerBeat * 2, Type: noteOffEvent, track: 3},
+	}
+	path := filepath.Join(t.TempDir(), "test.mid")
+	assert.Nil(t, s.exportSMF(path))
+
+	s2 := newSong(nil)
+	assert.Nil(t, s2.importSMF(path))
+
+	notes := eventsOfType(s2, noteOnEvent)
+	if assert.Len(t, notes, 2) {
+		assert.NotEqual(t, notes[0].track, notes[1].track)
+		pitches := []float64{notes[0].FloatData, notes[1].FloatData}
+		assert.Contains(t, []float64{pitches[0], pitches[1]}, 64.0)
+		for _, f := range pitches {
+			if f != 64 {
+				assert.InDelta(t, 60.5, f, 0.01)
+			}
+		}
+	}
+	bends := eventsOfType(s2, pitchBendEvent)
+	if assert.Len(t, bends, 1) {
+		assert.Equal(t, int64(ticksPerBeat), bends[0].Tick)
+		assert.InDelta(t, 62, bends[0].FloatData, 0.01)
+	}
+	assert.Len(t, eventsOfType(s2, noteOffEvent), 2)
+	if tempos := eventsOfType(s2, tempoEvent); assert.Len(t, tempos, 1) {
+		assert.InDelta(t, 90, tempos[0].FloatData, 0.01)
+	}
+	if texts := eventsOfType(s2, textEvent); assert.Len(t, texts, 1) {
+		assert.Equal(t, "chorus", texts[0].TextData)
+		assert.Equal(t, byte(6), texts[0].ByteData1)
+	}
+	if progs := eventsOfType(s2, programEvent); assert.NotEmpty(t, progs) {
+		assert.Equal(t, byte(5), progs[0].ByteData1)
+	}
+	found := false
+	for _, te := range eventsOfType(s2, controllerEvent) {
+		if te.ByteData1 == 7 && te.ByteData2 == 80 {
+			found = true
+		}
+	}
+	assert.True(t, found)
+
+	// one event per tick per track
+	for _, t2 := range s2.Tracks {
+		ticks := make(map[int64]bool)
+		for _, te := range t2.Events {
+			assert.False(t, ticks[te.Tick])
+			ticks[te.Tick] = true
+		}
+	}
+}
+
+func TestExportMultitrackSMF(t *testing.T) {
+	s := newSong(nil)
+	s.Title = "test"
+	s.Tracks[0].Events = []*trackEvent{
+		{Tick: 0, Type: tempoEvent, FloatData: 90},
+		{Tick: 0, Type: noteOnEvent, FloatData: 60, ByteData1: 100},
+		{Tick: ticksPerBeat, Type: noteOffEvent},
+	}
+	s.Tracks[1].Channel = 1
+	s.Tracks[1].Events = []*trackEvent{
+		{Tick: 0, Type: midiOutputEvent, ByteData1: 1, track: 1},
+		{Tick: ticksPerBeat / 2, Type: noteOnEvent, FloatData: 64, ByteData1: 100, track: 1},
+		{Tick: ticksPerBeat, Type: noteOffEvent, track: 1},
+	}
+	path := filepath.Join(t.TempDir(), "test.mid")
+	assert.Nil(t, s.exportMultitrackSMF(path, smfLayoutPerTrack))
+
+	names := make(map[int16]string)
+	ports := make(map[int16]uint8)
+	notes := make(map[int16][]uint64)
+	rd := reader.New(reader.NoLogger(),
+		reader.Each(func(pos *reader.Position, msg midi.Message) {
+			switch msg := msg.(type) {
+			case meta.TrackSequenceName:
+				names[pos.Track] = string(msg)
+			case meta.Port:
+				ports[pos.Track] = msg.Number()
+			case meta.Tempo:
+				assert.Equal(t, int16(0), pos.Track)
+			case channel.NoteOn:
+				notes[pos.Track] = append(notes[pos.Track], pos.AbsoluteTicks)
+			}
+		}),
+	)
+	assert.Nil(t, reader.ReadSMFFile(rd, path))
+	assert.Equal(t, uint16(5), rd.Header().NumTracks)
+	assert.Equal(t, map[int16]string{
+		0: "test",
+		1: "Setup (output 0)",
+		2: "Track 1 (channel 1) (output 0)",
+		3: "Setup (output 1)",
+		4: "Track 2 (channel 2) (output 1)",
+	}, names)
+	assert.Equal(t, map[int16]uint8{1: 0, 2: 0, 3: 1, 4: 1}, ports)
+	assert.Equal(t, map[int16][]uint64{2: {0}, 4: {ticksPerBeat / 2}}, notes)
+}
+
+func TestPlayEventRestoresSourceTrack(t *testing.T) {
+	var records []smfRecord
+	r := &smfRecorder{records: &records, track: -1}
+	s := newSong(nil)
+	p := newPlayer(s, []writer.ChannelWriter{r}, false)
+	p.playEvent(&trackEvent{Type: noteOnEvent, FloatData: 60, ByteData1: 100, track: 1})
+	if assert.NotEmpty(t, records) {
+		assert.Equal(t, 1, records[len(records)-1].lane.index)
+	}
+	assert.Equal(t, -1, r.track)
+}
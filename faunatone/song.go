@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"compress/zlib"
 	"encoding/json"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
 	"slices"
 	"strings"
@@ -36,7 +38,7 @@ const (
 	numMidiChannels        = 16
 	numVirtualChannels     = 16
 	percussionChannelIndex = 9
-	numMidiModes           = 5
+	numMidiModes           = 7
 )
 
 const (
@@ -45,6 +47,8 @@ const (
 	modeXG
 	modeMT32
 	modeMPE
+	modeMTS
+	modeMTSNonRealTime
 )
 
 var standardPitchNames = []string{
@@ -64,6 +68,10 @@ func midiModeName(index int) string {
 		return "MT-32"
 	case modeMPE:
 		return "MPE"
+	case modeMTS:
+		return "MTS"
+	case modeMTSNonRealTime:
+		return "MTS (NRT)"
 	}
 	return "Unknown"
 }
@@ -79,6 +87,7 @@ func midiModeTargets() []*tabTarget {
 // fields in these types are exported to expose them to the JSON encoder
 
 type song struct {
+	Version  int // see songformat.go
 	Title    string
 	Tracks   []*track
 	Keymap   *keymap
@@ -90,6 +99,7 @@ func newSong(k *keymap) *song {
 		k = newEmptyKeymap("none")
 	}
 	return &song{
+		Version: songFormatVersion,
 		Tracks: []*track{
 			newTrack(0, 0),
 			newTrack(0, 1),
@@ -106,23 +116,39 @@ func (s *song) read(r io.Reader) error {
 	if err != nil {
 		return err
 	}
-	dec := json.NewDecoder(comp)
-	newSong := &song{}
-	if err := dec.Decode(newSong); err != nil {
+	data, err := io.ReadAll(comp)
+	if err != nil {
 		return err
 	}
 	if err := comp.Close(); err != nil {
 		return err
 	}
+	if data, err = migrateSongData(data); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	newSong := &song{}
+	if err := dec.Decode(newSong); err != nil {
+		return err
+	}
+	if newSong.Keymap != nil {
+		for _, ki := range newSong.Keymap.Items {
+			if ki.PitchSrc == nil {
+				return fmt.Errorf("keymap item %q has no interval", ki.Key)
+			}
+		}
+	}
 	*s = *newSong
+	s.initDecoded()
+	return nil
+}
+
+// initialize unexported data of a freshly decoded song
+func (s *song) initDecoded() {
 	if s.Keymap == nil {
 		s.Keymap = newEmptyKeymap("none")
 	}
-	for _, ki := range s.Keymap.Items {
-		if ki.PitchSrc == nil {
-			ki.PitchSrc = newSemiPitch(ki.Interval)
-		}
-	}
 	s.Keymap.setMidiPattern()
 	s.Keymap.keyNotes = make(map[string]*trackEvent)
 	s.Keymap.keySig = make(map[float64]*pitchSrc)
@@ -130,21 +156,65 @@ func (s *song) read(r io.Reader) error {
 		t.index = i
 		t.activeNote = byteNil
 		t.midiChannel = byteNil
+		t.sortEvents()
 		for _, te := range t.Events {
 			te.track = i
 			te.setUiString(s.Keymap)
 		}
 	}
-	return nil
+}
+
+// read song data from a file, choosing the format by extension; if
+// successful, the current song data is replaced
+func (s *song) readFile(path string) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mid", ".midi":
+		return s.importSMF(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.EqualFold(filepath.Ext(path), textFileExt) {
+		return s.readText(f)
+	}
+	return s.read(f)
+}
+
+// write song data to a file, choosing the format by extension
+func (s *song) writeFile(path string) error {
+	var write func(io.Writer) error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mid", ".midi":
+		return s.exportSMF(path)
+	case ".wav":
+		return s.exportWAV(path)
+	case midiClipExt:
+		return s.exportMIDIClip(path)
+	case fileExt:
+		write = s.write
+	case textFileExt:
+		write = s.writeText
+	default:
+		return fmt.Errorf("unsupported output format: %s", path)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 // encode song data
 func (s *song) write(w io.Writer) error {
 	comp := zlib.NewWriter(w)
 	enc := json.NewEncoder(comp)
-	for _, ki := range s.Keymap.Items {
-		ki.Interval = ki.PitchSrc.semitones() // for backward compatibility
-	}
+	s.Version = songFormatVersion
 	if err := enc.Encode(s); err != nil {
 		return err
 	}
@@ -170,9 +240,20 @@ func appendToFilename(append, path string) string {
 	return strings.TrimSuffix(path, ext) + append + ext
 }
 
-// export to MIDI
+// error returned when an export had to steal voices
+type polyphonyError struct {
+	count int
+}
+
+func (e *polyphonyError) Error() string {
+	return fmt.Sprintf("polyphony limit exceeded by %d note(s)", e.count)
+}
+
+// export to MIDI. if the polyphony limit was exceeded, the files are still
+// written and a *polyphonyError is returned.
 func (s *song) exportSMF(path string) error {
 	usedOutputs := s.usedOutputs()
+	polyErrCount := 0
 	for _, output := range usedOutputs {
 		thisPath := path
 		if len(usedOutputs) > 1 {
@@ -188,15 +269,16 @@ func (s *song) exportSMF(path string) error {
 			p.signal <- playerSignal{typ: signalStart}
 			<-p.stopping
 			writer.EndOfTrack(wr)
-			if p.polyErrCount > 0 {
-				return fmt.Errorf("polyphony limit exceeded by %d note(s)", p.polyErrCount)
-			}
+			polyErrCount += p.polyErrCount
 			return nil
 		})
 		if err != nil {
 			return err
 		}
 	}
+	if polyErrCount > 0 {
+		return &polyphonyError{polyErrCount}
+	}
 	return nil
 }
 
@@ -214,6 +296,8 @@ func (s *song) renameNotes() {
 type track struct {
 	Channel uint8
 	Events  []*trackEvent
+	Mute    bool
+	Solo    bool
 	index   int // only used by undo/redo
 
 	// only used by player
@@ -232,23 +316,28 @@ func newTrack(channel uint8, index int) *track {
 	}
 }
 
+// return true if the track should be heard, given the mute and solo flags of
+// every track
+func (s *song) trackAudible(t *track) bool {
+	if t.Mute {
+		return false
+	}
+	for _, t2 := range s.Tracks {
+		if t2.Solo {
+			return t.Solo
+		}
+	}
+	return true
+}
+
 // return a copy of the track with nil playback data
 func (t *track) clone() *track {
 	t2 := newTrack(t.Channel, t.index)
 	t2.Events = t.Events
+	t2.Mute, t2.Solo = t.Mute, t.Solo
 	return t2
 }
 
-// return the event at the tick in the track, if any
-func (t *track) getEventAtTick(tick int64) *trackEvent {
-	for _, te := range t.Events {
-		if te.Tick == tick {
-			return te
-		}
-	}
-	return nil
-}
-
 type trackEvent struct {
 	Tick       int64
 	Type       trackEventType
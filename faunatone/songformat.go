@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// song format versioning. files without a version are version 0. when the
+// saved song data changes incompatibly, increment songFormatVersion and append
+// a migration that upgrades data from the previous version.
+
+const songFormatVersion = 2
+
+// each function upgrades decoded JSON song data from version i to i+1
+var songMigrations = []func(map[string]interface{}) error{
+	migrateKeymapIntervals,
+	migrateTrackFlags,
+}
+
+// upgrade JSON song data to the current format version and return it
+func migrateSongData(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber() // don't round tick values through float64
+	var raw map[string]interface{}
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	version := 0
+	if v, ok := raw["Version"]; ok {
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("invalid song format version: %v", v)
+		}
+		i, err := n.Int64()
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("invalid song format version: %v", v)
+		}
+		version = int(i)
+	}
+	if err := checkSongFormatVersion(version); err != nil {
+		return nil, err
+	}
+	for ; version < songFormatVersion; version++ {
+		if err := songMigrations[version](raw); err != nil {
+			return nil, fmt.Errorf("migrating from version %d: %v", version, err)
+		}
+	}
+	raw["Version"] = songFormatVersion
+	return json.Marshal(raw)
+}
+
+// return an error if a song format version is newer than this program knows
+func checkSongFormatVersion(version int) error {
+	if version > songFormatVersion {
+		return fmt.Errorf(
+			"song was saved by a newer version of %s (format version %d; this "+
+				"version supports up to %d)", appName, version, songFormatVersion)
+	}
+	return nil
+}
+
+// version 0 -> 1: keymap items used to store intervals only as a number of
+// semitones in the Interval field. PitchSrc superseded it, but Interval was
+// still written for backward compatibility.
+func migrateKeymapIntervals(raw map[string]interface{}) error {
+	k, ok := raw["Keymap"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	items, ok := k["Items"].([]interface{})
+	if !ok {
+		return nil
+	}
+	for _, item := range items {
+		ki, ok := item.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid keymap item: %v", item)
+		}
+		if ki["PitchSrc"] == nil {
+			ki["PitchSrc"] = map[string]interface{}{"Float": ki["Interval"]}
+		}
+		delete(ki, "Interval")
+	}
+	return nil
+}
+
+// version 1 -> 2: tracks gained Mute and Solo flags, which default to false.
+// older versions can't read them, so files with them need the new version.
+func migrateTrackFlags(raw map[string]interface{}) error {
+	return nil
+}
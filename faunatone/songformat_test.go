@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// return zlib-compressed data
+func compress(t *testing.T, s string) *bytes.Buffer {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	_, err := w.Write([]byte(s))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	return &b
+}
+
+func TestSongFormatMigration(t *testing.T) {
+	// version 0, with a legacy interval and a pitch source
+	s := newSong(nil)
+	err := s.read(compress(t, `{"Title":"old","Tracks":[{"Channel":1,"Events":[
+		{"Tick":9007199254740993,"Type":1,"FloatData":60,"ByteData1":100}]}],
+		"Keymap":{"Name":"k","Items":[
+		{"Key":"Q","IsMod":false,"Interval":2.5,"Name":"a","PitchSrc":null},
+		{"Key":"W","IsMod":false,"Interval":7.01955,"Name":"b","PitchSrc":{"Ints":[3,2]}}]},
+		"MidiMode":2}`))
+	assert.Nil(t, err)
+	assert.Equal(t, songFormatVersion, s.Version)
+	assert.Equal(t, "old", s.Title)
+	assert.Equal(t, int64(9007199254740993), s.Tracks[0].Events[0].Tick)
+	assert.Equal(t, *newSemiPitch(2.5), *s.Keymap.Items[0].PitchSrc)
+	assert.Equal(t, *newRatPitch(3, 2), *s.Keymap.Items[1].PitchSrc)
+	assert.Equal(t, modeXG, s.MidiMode)
+
+	// written files are current and have no legacy fields
+	var b bytes.Buffer
+	assert.Nil(t, s.write(&b))
+	r, err := zlib.NewReader(&b)
+	assert.Nil(t, err)
+	var out bytes.Buffer
+	_, err = out.ReadFrom(r)
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), `"Version":2`)
+	assert.NotContains(t, out.String(), "Interval")
+}
+
+func TestSongFormatErrors(t *testing.T) {
+	s := newSong(nil)
+	err := s.read(compress(t, `{"Version":1000,"Title":"new"}`))
+	assert.ErrorContains(t, err, "newer version")
+	assert.Equal(t, "", s.Title)
+	assert.NotNil(t, s.read(compress(t, `{"Version":1,"Title":"x","Surprise":true}`)))
+	assert.NotNil(t, s.read(compress(t, `{"Version":"one"}`)))
+}
+
+func TestSongFormatVersion2(t *testing.T) {
+	// track flags are saved as version 2, which a version 1 reader refuses
+	// with a clear error instead of failing on the unknown fields
+	s := newSong(nil)
+	s.Tracks[0].Mute = true
+	var b bytes.Buffer
+	assert.Nil(t, s.write(&b))
+	r, err := zlib.NewReader(&b)
+	assert.Nil(t, err)
+	var out bytes.Buffer
+	_, err = out.ReadFrom(r)
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), `"Version":2`)
+	var text bytes.Buffer
+	assert.Nil(t, s.writeText(&text))
+	assert.Contains(t, text.String(), "\nversion 2\n")
+	err = s.read(compress(t, `{"Version":3,"Tracks":[{"Channel":0,"Mute":true}]}`))
+	assert.ErrorContains(t, err, "format version 3; this version supports up to 2")
+
+	// version 1 files read as before
+	assert.Nil(t, s.read(compress(t, `{"Version":1,"Tracks":[{"Channel":0,"Events":[]}]}`)))
+	assert.Equal(t, 2, s.Version)
+	assert.False(t, s.Tracks[0].Mute)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// plain-text song format, for readable diffs. the file is a header line
+// followed by one directive per line:
+//
+//	version FORMATVERSION
+//	title "TEXT"
+//	mode INDEX
+//	keymap "NAME"
+//	key "KEY" "NAME" ISMOD PITCH
+//	track CHANNEL [mute] [solo]
+//	TICK TYPE ARGS...
+//
+// event lines belong to the most recent track. a key's PITCH is x if it's a
+// MIDI key that doesn't play a note. blank lines and lines starting with # are
+// ignored.
+
+const (
+	textFileExt    = ".faunt"
+	textFileHeader = "faunatone text"
+)
+
+// describes how an event type is written in the text format. each byte of
+// fields names an event field: f for FloatData, 1-3 for ByteData1-3, and t for
+// TextData.
+type textEventSpec struct {
+	name   string
+	fields string
+}
+
+var textEventSpecs = map[trackEventType]textEventSpec{
+	noteOffEvent:         {"off", ""},
+	noteOnEvent:          {"on", "f1"},
+	controllerEvent:      {"cc", "12"},
+	programEvent:         {"prog", "123"},
+	tempoEvent:           {"tempo", "f12"},
+	drumNoteOnEvent:      {"drum", "12"},
+	pitchBendEvent:       {"bend", "f"},
+	keyPressureEvent:     {"kp", "1"},
+	channelPressureEvent: {"af", "1"},
+	textEvent:            {"text", "1t"},
+	releaseLenEvent:      {"rel", "f"},
+	midiRangeEvent:       {"chn", "12"},
+	midiOutputEvent:      {"out", "1"},
+	mt32ReverbEvent:      {"rv", "123"},
+	midiModeEvent:        {"mode", "1"},
+}
+
+// encode song data as text
+func (s *song) writeText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, textFileHeader)
+	fmt.Fprintf(bw, "version %d\n", songFormatVersion)
+	fmt.Fprintf(bw, "title %s\n", strconv.Quote(s.Title))
+	fmt.Fprintf(bw, "mode %d\n", s.MidiMode)
+	fmt.Fprintf(bw, "keymap %s\n", strconv.Quote(s.Keymap.Name))
+	for _, ki := range s.Keymap.Items {
+		pitch := formatTextPitch(ki.PitchSrc)
+		if ki.Unmapped {
+			pitch = "x"
+		}
+		fmt.Fprintf(bw, "key %s %s %t %s\n", strconv.Quote(ki.Key),
+			strconv.Quote(ki.Name), ki.IsMod, pitch)
+	}
+	for _, t := range s.Tracks {
+		fmt.Fprintf(bw, "\ntrack %d%s%s\n", t.Channel,
+			conditionalString(t.Mute, " mute", ""), conditionalString(t.Solo, " solo", ""))
+		events := make([]*trackEvent, len(t.Events))
+		copy(events, t.Events)
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].Tick < events[j].Tick
+		})
+		for _, te := range events {
+			line, err := formatTextEvent(te)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(bw, line)
+		}
+	}
+	return bw.Flush()
+}
+
+// decode text song data; if successful, the current song data is replaced
+func (s *song) readText(r io.Reader) error {
+	newSong := &song{Version: songFormatVersion, Keymap: newEmptyKeymap("none")}
+	var t *track
+	sc := bufio.NewScanner(r)
+	lineNum := 0
+	for sc.Scan() {
+		lineNum++
+		line := strings.TrimSpace(sc.Text())
+		if lineNum == 1 {
+			if line != textFileHeader {
+				return fmt.Errorf("not a faunatone text file")
+			}
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields, err := splitTextFields(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		if err := newSong.applyTextFields(fields, &t); err != nil {
+			return fmt.Errorf("line %d: %v", lineNum, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if lineNum == 0 {
+		return fmt.Errorf("not a faunatone text file")
+	}
+	if len(newSong.Tracks) == 0 {
+		newSong.Tracks = append(newSong.Tracks, newTrack(0, 0))
+	}
+	*s = *newSong
+	s.initDecoded()
+	return nil
+}
+
+// apply one line of the text format; t is the current track
+func (s *song) applyTextFields(fields []string, t **track) error {
+	argc := map[string]int{"version": 2, "title": 2, "mode": 2, "keymap": 2, "key": 5}
+	if n, ok := argc[fields[0]]; ok && len(fields) != n {
+		return fmt.Errorf("wrong number of fields for %s", fields[0])
+	} else if fields[0] == "track" && (len(fields) < 2 || len(fields) > 4) {
+		return fmt.Errorf("wrong number of fields for %s", fields[0])
+	}
+	switch fields[0] {
+	case "version":
+		version, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return err
+		}
+		// the text format is newer than any migrations, so only check
+		if err := checkSongFormatVersion(version); err != nil {
+			return err
+		}
+	case "title":
+		s.Title = fields[1]
+	case "mode":
+		mode, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return err
+		}
+		s.MidiMode = mode
+	case "keymap":
+		s.Keymap.Name = fields[1]
+	case "key":
+		isMod, err := strconv.ParseBool(fields[3])
+		if err != nil {
+			return err
+		}
+		if fields[4] == "x" {
+			ki := newKeyInfo(fields[1], isMod, fields[2], newSemiPitch(0))
+			ki.Unmapped = true
+			s.Keymap.Items = append(s.Keymap.Items, ki)
+			break
+		}
+		ps, err := parseTextPitch(fields[4])
+		if err != nil {
+			return err
+		}
+		s.Keymap.Items = append(s.Keymap.Items, newKeyInfo(fields[1], isMod, fields[2], ps))
+	case "track":
+		channel, err := strconv.ParseUint(fields[1], 10, 8)
+		if err != nil {
+			return err
+		}
+		*t = newTrack(uint8(channel), len(s.Tracks))
+		for _, flag := range fields[2:] {
+			switch flag {
+			case "mute":
+				(*t).Mute = true
+			case "solo":
+				(*t).Solo = true
+			default:
+				return fmt.Errorf("unknown track flag %q", flag)
+			}
+		}
+		s.Tracks = append(s.Tracks, *t)
+	default:
+		if *t == nil {
+			return fmt.Errorf("event before first track")
+		}
+		te, err := parseTextEvent(fields)
+		if err != nil {
+			return err
+		}
+		if (*t).getEventAtTick(te.Tick) != nil {
+			return fmt.Errorf("multiple events at tick %d", te.Tick)
+		}
+		(*t).insertEvent(te)
+	}
+	return nil
+}
+
+// return the text format line for an event
+func formatTextEvent(te *trackEvent) (string, error) {
+	spec, ok := textEventSpecs[te.Type]
+	if !ok {
+		return "", fmt.Errorf("unknown event type %d", te.Type)
+	}
+	a := []string{strconv.FormatInt(te.Tick, 10), spec.name}
+	for _, c := range spec.fields {
+		switch c {
+		case 'f':
+			a = append(a, strconv.FormatFloat(te.FloatData, 'g', -1, 64))
+		case '1':
+			a = append(a, strconv.Itoa(int(te.ByteData1)))
+		case '2':
+			a = append(a, strconv.Itoa(int(te.ByteData2)))
+		case '3':
+			a = append(a, strconv.Itoa(int(te.ByteData3)))
+		case 't':
+			a = append(a, strconv.Quote(te.TextData))
+		}
+	}
+	return strings.Join(a, " "), nil
+}
+
+// parse the fields of an event line
+func parseTextEvent(fields []string) (*trackEvent, error) {
+	tick, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unknown directive %q", fields[0])
+	}
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("missing event type")
+	}
+	te := &trackEvent{Tick: tick}
+	var spec textEventSpec
+	ok := false
+	for et, s := range textEventSpecs {
+		if s.name == fields[1] {
+			te.Type, spec, ok = et, s, true
+			break
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown event type %q", fields[1])
+	}
+	if len(fields) != len(spec.fields)+2 {
+		return nil, fmt.Errorf("wrong number of fields for %s", spec.name)
+	}
+	for i, c := range spec.fields {
+		arg := fields[i+2]
+		var b uint64
+		if c >= '1' && c <= '3' {
+			if b, err = strconv.ParseUint(arg, 10, 8); err != nil {
+				return nil, err
+			}
+		}
+		switch c {
+		case 'f':
+			if te.FloatData, err = strconv.ParseFloat(arg, 64); err != nil {
+				return nil, err
+			}
+		case '1':
+			te.ByteData1 = byte(b)
+		case '2':
+			te.ByteData2 = byte(b)
+		case '3':
+			te.ByteData3 = byte(b)
+		case 't':
+			te.TextData = arg
+		}
+	}
+	return te, nil
+}
+
+// return a lossless string representation of an interval: a number of
+// semitones, a ratio N/D, or an equal division step S\N, followed by @P if the
+// divided interval is not an octave
+func formatTextPitch(ps *pitchSrc) string {
+	if ps.Ints[1] == 0 {
+		return strconv.FormatFloat(ps.Float, 'g', -1, 64)
+	} else if ps.IsEdx {
+		s := fmt.Sprintf("%d\\%d", ps.Ints[0], ps.Ints[1])
+		if ps.Float != 12 {
+			s += "@" + strconv.FormatFloat(ps.Float, 'g', -1, 64)
+		}
+		return s
+	}
+	return fmt.Sprintf("%d/%d", ps.Ints[0], ps.Ints[1])
+}
+
+// parse the output of formatTextPitch
+func parseTextPitch(s string) (*pitchSrc, error) {
+	if i := strings.Index(s, "/"); i != -1 {
+		num, err1 := strconv.Atoi(s[:i])
+		den, err2 := strconv.Atoi(s[i+1:])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid pitch %q", s)
+		}
+		return newRatPitch(num, den), nil
+	} else if i := strings.Index(s, "\\"); i != -1 {
+		interval := 12.0
+		rest := s[i+1:]
+		if j := strings.Index(rest, "@"); j != -1 {
+			f, err := strconv.ParseFloat(rest[j+1:], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pitch %q", s)
+			}
+			interval, rest = f, rest[:j]
+		}
+		steps, err1 := strconv.Atoi(s[:i])
+		divs, err2 := strconv.Atoi(rest)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid pitch %q", s)
+		}
+		return newEdxPitch(interval, steps, divs), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pitch %q", s)
+	}
+	return newSemiPitch(f), nil
+}
+
+// split a line into whitespace-separated fields, unquoting quoted strings
+func splitTextFields(line string) ([]string, error) {
+	var fields []string
+	for {
+		line = strings.TrimLeft(line, " \t\r")
+		if line == "" {
+			return fields, nil
+		}
+		if line[0] == '"' {
+			q, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, fmt.Errorf("bad quoted string")
+			}
+			s, _ := strconv.Unquote(q)
+			fields = append(fields, s)
+			line = line[len(q):]
+		} else {
+			i := strings.IndexAny(line, " \t\r")
+			if i == -1 {
+				i = len(line)
+			}
+			fields = append(fields, line[:i])
+			line = line[i:]
+		}
+	}
+}
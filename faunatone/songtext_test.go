@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSongTextRoundTrip(t *testing.T) {
+	s := newSong(newEmptyKeymap("test map"))
+	s.Title = "A \"quoted\" title"
+	s.MidiMode = modeMTS
+	s.Keymap.Items = []*keyInfo{
+		newKeyInfo("Q", false, "C", newSemiPitch(0)),
+		newKeyInfo("W", false, "D", newRatPitch(9, 8)),
+		newKeyInfo("E", false, "E", newEdxPitch(12, 4, 12)),
+		newKeyInfo("R", false, "F", newEdxPitch(19.0195500086539, 5, 13)),
+		newKeyInfo("2", true, "#", newSemiPitch(0.333)),
+		newKeyInfo("m60", false, "C", newSemiPitch(0)),
+		newKeyInfo("m61", false, "", newSemiPitch(0)),
+		newKeyInfo("m62", false, "D", newSemiPitch(2)),
+	}
+	s.Keymap.Items[6].Unmapped = true
+	s.Tracks[0].Channel = 3
+	for i := noteOffEvent; i <= midiModeEvent; i++ {
+		s.Tracks[0].Events = append(s.Tracks[0].Events, &trackEvent{
+			Tick:      int64(i) * 240,
+			Type:      i,
+			FloatData: 60.125,
+			ByteData1: 1,
+			ByteData2: 2,
+			ByteData3: 3,
+			TextData:  "some text\n",
+		})
+	}
+	s.Tracks[2].Events = []*trackEvent{
+		{Tick: 480, Type: noteOnEvent, FloatData: 64, ByteData1: 100},
+		{Tick: 0, Type: noteOnEvent, FloatData: 62.5, ByteData1: 90},
+	}
+	s.Tracks[1].Mute = true
+	s.Tracks[2].Mute, s.Tracks[2].Solo = true, true
+
+	var b bytes.Buffer
+	assert.Nil(t, s.writeText(&b))
+	text := b.String()
+	s2 := newSong(nil)
+	assert.Nil(t, s2.readText(&b))
+
+	assert.Equal(t, s.Title, s2.Title)
+	assert.Equal(t, s.MidiMode, s2.MidiMode)
+	assert.Equal(t, s.Keymap.Name, s2.Keymap.Name)
+	assert.Equal(t, len(s.Keymap.Items), len(s2.Keymap.Items))
+	for i, ki := range s.Keymap.Items {
+		assert.Equal(t, *ki, *s2.Keymap.Items[i])
+	}
+	assert.True(t, s2.Keymap.midiUnmap[61])
+	assert.False(t, s2.Keymap.midiUnmap[62])
+	assert.Equal(t, len(s.Tracks), len(s2.Tracks))
+	assert.Equal(t, uint8(3), s2.Tracks[0].Channel)
+	for i, tr := range s.Tracks {
+		assert.Equal(t, tr.Mute, s2.Tracks[i].Mute)
+		assert.Equal(t, tr.Solo, s2.Tracks[i].Solo)
+	}
+	for i, te := range s.Tracks[0].Events {
+		te2 := s2.Tracks[0].Events[i]
+		spec := textEventSpecs[te.Type]
+		assert.Equal(t, te.Tick, te2.Tick)
+		assert.Equal(t, te.Type, te2.Type)
+		for _, c := range spec.fields {
+			switch c {
+			case 'f':
+				assert.Equal(t, te.FloatData, te2.FloatData)
+			case '1':
+				assert.Equal(t, te.ByteData1, te2.ByteData1)
+			case '2':
+				assert.Equal(t, te.ByteData2, te2.ByteData2)
+			case '3':
+				assert.Equal(t, te.ByteData3, te2.ByteData3)
+			case 't':
+				assert.Equal(t, te.TextData, te2.TextData)
+			}
+		}
+	}
+
+	// events are written in tick order
+	assert.Equal(t, int64(0), s2.Tracks[2].Events[0].Tick)
+	assert.Equal(t, 62.5, s2.Tracks[2].Events[0].FloatData)
+
+	// writing again gives identical output
+	b.Reset()
+	assert.Nil(t, s2.writeText(&b))
+	assert.Equal(t, text, b.String())
+}
+
+func TestSongTextErrors(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"not a song\n",
+		textFileHeader + "\n0 on 60 100\n",
+		textFileHeader + "\ntrack 0\n0 on 60\n",
+		textFileHeader + "\ntrack 0\n0 nope\n",
+		textFileHeader + "\ntrack 0\n0 off\n0 off\n",
+		textFileHeader + "\ntrack 0 loud\n",
+		textFileHeader + "\nkey \"Q\" \"C\" false 3\\x\n",
+		textFileHeader + "\ntitle \"unterminated\n",
+		textFileHeader + "\nversion 1000\n",
+	} {
+		assert.NotNil(t, newSong(nil).readText(bytes.NewBufferString(text)), text)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// reading of SoundFont 2 files for the built-in synth. only the parts needed
+// for basic sample playback are supported: key and velocity ranges, tuning,
+// sample offsets and loops, attenuation, pan, and the volume envelope.
+// modulators and effects are ignored.
+
+// generator operators
+const (
+	sf2StartAddrsOffset       = 0
+	sf2EndAddrsOffset         = 1
+	sf2StartloopAddrsOffset   = 2
+	sf2EndloopAddrsOffset     = 3
+	sf2StartAddrsCoarseOffset = 4
+	sf2EndAddrsCoarseOffset   = 12
+	sf2Pan                    = 17
+	sf2DelayVolEnv            = 33
+	sf2AttackVolEnv           = 34
+	sf2HoldVolEnv             = 35
+	sf2DecayVolEnv            = 36
+	sf2SustainVolEnv          = 37
+	sf2ReleaseVolEnv          = 38
+	sf2Instrument             = 41
+	sf2KeyRange               = 43
+	sf2VelRange               = 44
+	sf2StartloopCoarseOffset  = 45
+	sf2InitialAttenuation     = 48
+	sf2EndloopCoarseOffset    = 50
+	sf2CoarseTune             = 51
+	sf2FineTune               = 52
+	sf2SampleID               = 53
+	sf2SampleModes            = 54
+	sf2ScaleTuning            = 56
+	sf2OverridingRootKey      = 58
+	sf2NumGenerators          = 61
+
+	sf2PercussionBank = 128
+)
+
+type soundFont struct {
+	samples []int16
+	presets map[uint32]*sf2Preset // keyed by bank<<8 | program
+}
+
+type sf2Preset struct {
+	name    string
+	regions []*sf2Region
+}
+
+// a combination of a preset zone, an instrument zone, and a sample
+type sf2Region struct {
+	keyLo, keyHi uint8
+	velLo, velHi uint8
+
+	start, end          int // indices into soundFont.samples
+	loopStart, loopEnd  int
+	loopMode            int // 0 = none, 1 = continuous, 3 = until release
+	sampleRate          float64
+	rootKey             float64
+	tune                float64 // cents
+	scaleTuning         float64 // cents per key
+	attenuation         float64 // centibels
+	pan                 float64 // -0.5 to 0.5
+	delay, attack, hold float64 // seconds
+	decay, release      float64 // ^
+	sustain             float64 // level, 0 to 1
+}
+
+// list of generator values, with a flag for each that says whether it's set
+type sf2Generators struct {
+	amount [sf2NumGenerators]int16
+	set    [sf2NumGenerators]bool
+}
+
+// return the value of a range generator
+func (g *sf2Generators) rangeOf(op int) (uint8, uint8) {
+	if !g.set[op] {
+		return 0, 127
+	}
+	return uint8(g.amount[op]), uint8(uint16(g.amount[op]) >> 8)
+}
+
+// read a SoundFont from a path. relative paths are relative to the Faunatone
+// folder.
+func readSoundFontFile(path string) (*soundFont, error) {
+	if !filepath.IsAbs(path) {
+		path = joinTreePath(path)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sf, err := parseSoundFont(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Base(path), err)
+	}
+	return sf, nil
+}
+
+// return the chunks in a RIFF list body, keyed by ID. LIST chunks are keyed
+// by their list type instead.
+func riffChunks(b []byte) (map[string][]byte, error) {
+	chunks := make(map[string][]byte)
+	for len(b) >= 8 {
+		id := string(b[:4])
+		size := int(binary.LittleEndian.Uint32(b[4:]))
+		if size > len(b)-8 {
+			return nil, fmt.Errorf("truncated %q chunk", id)
+		}
+		data := b[8 : 8+size]
+		if id == "LIST" && len(data) >= 4 {
+			id, data = string(data[:4]), data[4:]
+		}
+		chunks[id] = data
+		next := 8 + size + size%2
+		if next > len(b) {
+			next = len(b) // the last chunk's pad byte may be missing
+		}
+		b = b[next:]
+	}
+	return chunks, nil
+}
+
+// parse a SoundFont 2 file
+func parseSoundFont(b []byte) (*soundFont, error) {
+	if len(b) < 12 || string(b[:4]) != "RIFF" || string(b[8:12]) != "sfbk" {
+		return nil, fmt.Errorf("not a SoundFont 2 file")
+	}
+	top, err := riffChunks(b[12:])
+	if err != nil {
+		return nil, err
+	}
+	sdta, err := riffChunks(top["sdta"])
+	if err != nil {
+		return nil, err
+	}
+	pdta, err := riffChunks(top["pdta"])
+	if err != nil {
+		return nil, err
+	}
+	sf := &soundFont{
+		samples: make([]int16, len(sdta["smpl"])/2),
+		presets: make(map[uint32]*sf2Preset),
+	}
+	binary.Read(bytes.NewReader(sdta["smpl"]), binary.LittleEndian, sf.samples)
+
+	// record sizes from the spec; every list ends with a terminal record
+	for id, size := range map[string]int{
+		"phdr": 38, "pbag": 4, "pgen": 4, "inst": 22, "ibag": 4, "igen": 4, "shdr": 46,
+	} {
+		if len(pdta[id]) < size*2 || len(pdta[id])%size != 0 {
+			return nil, fmt.Errorf("missing or malformed %q chunk", id)
+		}
+	}
+	pbags := parseSF2Bags(pdta["pbag"])
+	ibags := parseSF2Bags(pdta["ibag"])
+	pgens := parseSF2Gens(pdta["pgen"])
+	igens := parseSF2Gens(pdta["igen"])
+	phdr, inst, shdr := pdta["phdr"], pdta["inst"], pdta["shdr"]
+
+	// return the generators of each zone in a bag range, with the global zone
+	// (if any) applied to the others
+	zones := func(bags []int, gens [][2]uint16, lo, hi, indexOp int) ([]*sf2Generators, error) {
+		if lo > hi || hi >= len(bags) {
+			return nil, fmt.Errorf("bad bag index")
+		}
+		var result []*sf2Generators
+		global := &sf2Generators{}
+		for i := lo; i < hi; i++ {
+			if bags[i] > bags[i+1] || bags[i+1] > len(gens) {
+				return nil, fmt.Errorf("bad generator index")
+			}
+			g := &sf2Generators{}
+			for _, gen := range gens[bags[i]:bags[i+1]] {
+				if int(gen[0]) < sf2NumGenerators {
+					g.amount[gen[0]], g.set[gen[0]] = int16(gen[1]), true
+				}
+			}
+			if g.set[indexOp] {
+				result = append(result, g)
+			} else if i == lo {
+				global = g
+			}
+		}
+		for _, g := range result {
+			for op := range g.amount {
+				if !g.set[op] && global.set[op] {
+					g.amount[op], g.set[op] = global.amount[op], true
+				}
+			}
+		}
+		return result, nil
+	}
+
+	for i := 0; i+1 < len(phdr)/38; i++ {
+		rec := phdr[i*38:]
+		name := strings.TrimRight(string(rec[:20]), "\x00")
+		program := binary.LittleEndian.Uint16(rec[20:])
+		bank := binary.LittleEndian.Uint16(rec[22:])
+		lo := int(binary.LittleEndian.Uint16(rec[24:]))
+		hi := int(binary.LittleEndian.Uint16(rec[38+24:]))
+		pzones, err := zones(pbags, pgens, lo, hi, sf2Instrument)
+		if err != nil {
+			return nil, fmt.Errorf("preset %q: %v", name, err)
+		}
+		preset := &sf2Preset{name: name}
+		for _, pz := range pzones {
+			instIndex := int(uint16(pz.amount[sf2Instrument]))
+			if instIndex+1 >= len(inst)/22 {
+				return nil, fmt.Errorf("preset %q: bad instrument index", name)
+			}
+			lo := int(binary.LittleEndian.Uint16(inst[instIndex*22+20:]))
+			hi := int(binary.LittleEndian.Uint16(inst[(instIndex+1)*22+20:]))
+			izones, err := zones(ibags, igens, lo, hi, sf2SampleID)
+			if err != nil {
+				return nil, fmt.Errorf("preset %q: %v", name, err)
+			}
+			for _, iz := range izones {
+				sampleIndex := int(uint16(iz.amount[sf2SampleID]))
+				if sampleIndex+1 >= len(shdr)/46 {
+					return nil, fmt.Errorf("preset %q: bad sample index", name)
+				}
+				if r := newSF2Region(pz, iz, shdr[sampleIndex*46:], len(sf.samples)); r != nil {
+					preset.regions = append(preset.regions, r)
+				}
+			}
+		}
+		sf.presets[uint32(bank)<<8|uint32(program)] = preset
+	}
+	return sf, nil
+}
+
+// parse bag records into generator indices
+func parseSF2Bags(b []byte) []int {
+	bags := make([]int, len(b)/4)
+	for i := range bags {
+		bags[i] = int(binary.LittleEndian.Uint16(b[i*4:]))
+	}
+	return bags
+}
+
+// parse generator records into operator and amount pairs
+func parseSF2Gens(b []byte) [][2]uint16 {
+	gens := make([][2]uint16, len(b)/4)
+	for i := range gens {
+		gens[i] = [2]uint16{
+			binary.LittleEndian.Uint16(b[i*4:]),
+			binary.LittleEndian.Uint16(b[i*4+2:]),
+		}
+	}
+	return gens
+}
+
+// combine preset and instrument zones and a sample header into a region.
+// returns nil if the zones don't overlap or the sample is invalid.
+func newSF2Region(pz, iz *sf2Generators, shdr []byte, numSamples int) *sf2Region {
+	r := &sf2Region{}
+	pkLo, pkHi := pz.rangeOf(sf2KeyRange)
+	ikLo, ikHi := iz.rangeOf(sf2KeyRange)
+	pvLo, pvHi := pz.rangeOf(sf2VelRange)
+	ivLo, ivHi := iz.rangeOf(sf2VelRange)
+	r.keyLo, r.keyHi = maxUint8(pkLo, ikLo), minUint8(pkHi, ikHi)
+	r.velLo, r.velHi = maxUint8(pvLo, ivLo), minUint8(pvHi, ivHi)
+	if r.keyLo > r.keyHi || r.velLo > r.velHi {
+		return nil
+	}
+
+	// instrument values replace defaults, and preset values add to them
+	val := func(op int, def int16) float64 {
+		v := float64(def)
+		if iz.set[op] {
+			v = float64(iz.amount[op])
+		}
+		if pz.set[op] {
+			v += float64(pz.amount[op])
+		}
+		return v
+	}
+	// instrument-only values
+	ival := func(op int, def int16) int {
+		if iz.set[op] {
+			return int(iz.amount[op])
+		}
+		return int(def)
+	}
+	timecents := func(op int) float64 {
+		return math.Pow(2, val(op, -12000)/1200)
+	}
+
+	start := int(binary.LittleEndian.Uint32(shdr[20:]))
+	end := int(binary.LittleEndian.Uint32(shdr[24:]))
+	loopStart := int(binary.LittleEndian.Uint32(shdr[28:]))
+	loopEnd := int(binary.LittleEndian.Uint32(shdr[32:]))
+	r.sampleRate = float64(binary.LittleEndian.Uint32(shdr[36:]))
+	originalPitch := int(shdr[40])
+	pitchCorrection := int(int8(shdr[41]))
+
+	r.start = start + ival(sf2StartAddrsOffset, 0) + ival(sf2StartAddrsCoarseOffset, 0)*32768
+	r.end = end + ival(sf2EndAddrsOffset, 0) + ival(sf2EndAddrsCoarseOffset, 0)*32768
+	r.loopStart = loopStart + ival(sf2StartloopAddrsOffset, 0) +
+		ival(sf2StartloopCoarseOffset, 0)*32768
+	r.loopEnd = loopEnd + ival(sf2EndloopAddrsOffset, 0) +
+		ival(sf2EndloopCoarseOffset, 0)*32768
+	if r.start < 0 || r.end > numSamples || r.start >= r.end || r.sampleRate <= 0 {
+		return nil
+	}
+	r.loopMode = ival(sf2SampleModes, 0) & 3
+	if r.loopMode == 2 || r.loopStart < r.start || r.loopEnd > r.end ||
+		r.loopStart >= r.loopEnd {
+		r.loopMode = 0 // 2 is unused, and means no loop
+	}
+
+	r.rootKey = float64(originalPitch)
+	if originalPitch > 127 {
+		r.rootKey = 60 // as recommended by the spec
+	}
+	if root := ival(sf2OverridingRootKey, -1); root >= 0 && root <= 127 {
+		r.rootKey = float64(root)
+	}
+	r.tune = val(sf2CoarseTune, 0)*100 + val(sf2FineTune, 0) + float64(pitchCorrection)
+	r.scaleTuning = val(sf2ScaleTuning, 100)
+	r.attenuation = math.Max(0, val(sf2InitialAttenuation, 0))
+	r.pan = math.Max(-500, math.Min(500, val(sf2Pan, 0))) / 1000
+	r.delay = timecents(sf2DelayVolEnv)
+	r.attack = timecents(sf2AttackVolEnv)
+	r.hold = timecents(sf2HoldVolEnv)
+	r.decay = timecents(sf2DecayVolEnv)
+	r.release = timecents(sf2ReleaseVolEnv)
+	r.sustain = math.Pow(10, -math.Max(0, math.Min(1440, val(sf2SustainVolEnv, 0)))/200)
+	return r
+}
+
+// return the preset for a bank and program. if there's no exact match, fall
+// back to the GM bank (or the standard kit, for percussion).
+func (sf *soundFont) preset(bank, program uint16) *sf2Preset {
+	if p, ok := sf.presets[uint32(bank)<<8|uint32(program)]; ok {
+		return p
+	}
+	if bank == sf2PercussionBank {
+		return sf.presets[sf2PercussionBank<<8]
+	}
+	return sf.presets[uint32(program)]
+}
+
+// return the regions of the preset that play a key at a velocity
+func (p *sf2Preset) regionsFor(key, velocity uint8) []*sf2Region {
+	var rs []*sf2Region
+	for _, r := range p.regions {
+		if key >= r.keyLo && key <= r.keyHi && velocity >= r.velLo && velocity <= r.velHi {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+func minUint8(a, b uint8) uint8 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxUint8(a, b uint8) uint8 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// return a RIFF chunk
+func riffChunk(id string, data ...[]byte) []byte {
+	body := bytes.Join(data, nil)
+	b := append([]byte(id), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(body)))
+	b = append(b, body...)
+	if len(body)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// return little-endian bytes for a list of values
+func leBytes(vs ...interface{}) []byte {
+	buf := &bytes.Buffer{}
+	for _, v := range vs {
+		if s, ok := v.(string); ok {
+			name := make([]byte, 20)
+			copy(name, s)
+			buf.Write(name)
+		} else {
+			binary.Write(buf, binary.LittleEndian, v)
+		}
+	}
+	return buf.Bytes()
+}
+
+// return a SoundFont with one looped sine wave sample at 440 Hz, used by
+// program 0 in bank 0
+func testSoundFont() []byte {
+	smpl := &bytes.Buffer{}
+	for i := 0; i < 100; i++ {
+		binary.Write(smpl, binary.LittleEndian, int16(math.Sin(2*math.Pi*float64(i)/100)*16000))
+	}
+	u16, u32 := func(x int) uint16 { return uint16(x) }, func(x int) uint32 { return uint32(x) }
+	return riffChunk("RIFF", []byte("sfbk"),
+		riffChunk("LIST", []byte("INFO"), riffChunk("ifil", leBytes(u16(2), u16(1)))),
+		riffChunk("LIST", []byte("sdta"), riffChunk("smpl", smpl.Bytes())),
+		riffChunk("LIST", []byte("pdta"),
+			riffChunk("phdr",
+				leBytes("sine", u16(0), u16(0), u16(0), u32(0), u32(0), u32(0)),
+				leBytes("EOP", u16(0), u16(0), u16(1), u32(0), u32(0), u32(0))),
+			riffChunk("pbag", leBytes(u16(0), u16(0), u16(1), u16(0))),
+			riffChunk("pmod", make([]byte, 10)),
+			riffChunk("pgen", leBytes(u16(sf2Instrument), u16(0), u16(0), u16(0))),
+			riffChunk("inst", leBytes("sine", u16(0)), leBytes("EOI", u16(1))),
+			riffChunk("ibag", leBytes(u16(0), u16(0), u16(2), u16(0))),
+			riffChunk("imod", make([]byte, 10)),
+			riffChunk("igen", leBytes(u16(sf2SampleModes), u16(1),
+				u16(sf2SampleID), u16(0), u16(0), u16(0))),
+			riffChunk("shdr",
+				leBytes("sine", u32(0), u32(100), u32(0), u32(100), u32(44000),
+					uint8(69), int8(0), u16(0), u16(1)),
+				leBytes("EOS", u32(0), u32(0), u32(0), u32(0), u32(0),
+					uint8(0), int8(0), u16(0), u16(0)))))
+}
+
+func TestRIFFChunks(t *testing.T) {
+	// odd-sized last chunk without its pad byte
+	chunks, err := riffChunks([]byte{'a', 'b', 'c', 'd', 1, 0, 0, 0, 9})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]byte{"abcd": {9}}, chunks)
+
+	_, err = riffChunks([]byte{'a', 'b', 'c', 'd', 2, 0, 0, 0, 9})
+	assert.NotNil(t, err)
+}
+
+func TestParseSoundFont(t *testing.T) {
+	_, err := parseSoundFont([]byte("RIFF\x00\x00\x00\x00WAVE"))
+	assert.NotNil(t, err)
+
+	sf, err := parseSoundFont(testSoundFont())
+	assert.Nil(t, err)
+	p := sf.preset(0, 0)
+	if assert.NotNil(t, p) {
+		assert.Equal(t, "sine", p.name)
+		assert.Equal(t, 1, len(p.regionsFor(60, 100)))
+		r := p.regions[0]
+		assert.Equal(t, []int{0, 100, 0, 100, 1}, []int{r.start, r.end, r.loopStart, r.loopEnd, r.loopMode})
+		assert.Equal(t, 69.0, r.rootKey)
+	}
+	assert.Equal(t, p, sf.preset(3, 0)) // falls back to bank 0
+	assert.Nil(t, sf.preset(0, 1))
+}
+
+func TestExportWAVSoundFont(t *testing.T) {
+	sfPath := filepath.Join(t.TempDir(), "test.sf2")
+	assert.Nil(t, os.WriteFile(sfPath, testSoundFont(), 0644))
+	defer func(sp synthParams) { synthOptions = sp }(synthOptions)
+	synthOptions = synthParams{sampleRate: 44100, bitDepth: 16, waveform: "sine",
+		soundFont: sfPath}
+	sng := newSong(nil)
+	sng.Tracks[0].Events = []*trackEvent{
+		{Type: noteOnEvent, FloatData: 69.5, ByteData1: 127},
+		{Tick: ticksPerBeat, Type: noteOffEvent},
+	}
+	_, left, _ := renderTestWAV(t, sng)
+	assert.Greater(t, peak(left), 0.01)
+	assert.InDelta(t, 440*math.Pow(2, 0.5/12), zeroCrossingFreq(left[2205:19845], 44100), 0.5)
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/midimessage/channel"
+	"gitlab.com/gomidi/midi/writer"
+)
+
+// a simple built-in synthesizer, used to render songs to audio files without
+// an external synth. it plays basic waveforms, or samples from a SoundFont if
+// one is configured.
+
+const (
+	synthHeadroom    = 0.25 // gain applied to the mix to leave room for chords
+	synthDrumDecay   = 0.15 // seconds for a drum hit to decay by 60 dB
+	synthTailLimit   = 10   // max seconds to render after the song ends
+	synthDefaultBend = 2    // semitones, as in GM
+	wavHeaderSize    = 44
+)
+
+// parameters for the built-in synth, set from settings
+var synthOptions = synthParams{
+	sampleRate: 44100,
+	bitDepth:   16,
+	waveform:   "sine",
+	attack:     5,
+	decay:      200,
+	sustain:    70,
+	release:    150,
+	soundFont:  "",
+}
+
+type synthParams struct {
+	sampleRate int
+	bitDepth   int
+	waveform   string
+	attack     int // ms
+	decay      int // ms
+	sustain    int // percent
+	release    int // ms
+	soundFont  string
+}
+
+// return synth parameters from settings
+func (s *settings) synthParams() synthParams {
+	return synthParams{
+		sampleRate: s.AudioSampleRate,
+		bitDepth:   s.AudioBitDepth,
+		waveform:   s.AudioWaveform,
+		attack:     s.AudioAttack,
+		decay:      s.AudioDecay,
+		sustain:    s.AudioSustain,
+		release:    s.AudioRelease,
+		soundFont:  s.AudioSoundFont,
+	}
+}
+
+// return an error if the parameters can't be used for rendering
+func (sp synthParams) validate() error {
+	switch {
+	case sp.sampleRate < 8000 || sp.sampleRate > 192000:
+		return fmt.Errorf("audio sample rate must be between 8000 and 192000")
+	case sp.bitDepth != 16 && sp.bitDepth != 24:
+		return fmt.Errorf("audio bit depth must be 16 or 24")
+	case sp.waveform != "sine" && sp.waveform != "saw" && sp.waveform != "square":
+		return fmt.Errorf("unknown audio waveform: %q", sp.waveform)
+	case sp.attack < 0 || sp.decay < 0 || sp.release < 0:
+		return fmt.Errorf("audio envelope times can't be negative")
+	case sp.sustain < 0 || sp.sustain > 100:
+		return fmt.Errorf("audio sustain must be between 0 and 100")
+	}
+	return nil
+}
+
+// render the song to a WAV file using the built-in synth. if the polyphony
+// limit was exceeded, the file is still written and a *polyphonyError is
+// returned.
+func (s *song) exportWAV(path string) error {
+	if err := synthOptions.validate(); err != nil {
+		return err
+	}
+	var font *soundFont
+	if synthOptions.soundFont != "" {
+		var err error
+		if font, err = readSoundFontFile(synthOptions.soundFont); err != nil {
+			return err
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	numOutputs := 1
+	for _, output := range s.usedOutputs() {
+		if output >= numOutputs {
+			numOutputs = output + 1
+		}
+	}
+	sy := newSynth(synthOptions, font, f, numOutputs)
+	p := newPlayer(s, sy.writers(), false)
+	go p.run()
+	p.sendStopping = true
+	p.signal <- playerSignal{typ: signalStart}
+	<-p.stopping
+	if err := sy.finish(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if p.polyErrCount > 0 {
+		return &polyphonyError{p.polyErrCount}
+	}
+	return nil
+}
+
+type synth struct {
+	params   synthParams
+	font     *soundFont // nil if using basic waveforms
+	file     io.WriteSeeker
+	out      *bufio.Writer
+	frames   int64 // number of stereo frames written
+	channels [][numMidiChannels]*synthChannel
+	voices   []*synthVoice
+	noise    *rand.Rand
+	err      error // first write error, if any
+}
+
+// state of a midi channel on one of the synth's outputs
+type synthChannel struct {
+	volume     uint8
+	expression uint8
+	pan        uint8
+	bend       int16
+	bendRange  float64 // semitones
+	rpn        [2]uint8
+	program    uint8
+	bank       uint8             // MSB
+	exact      map[uint8]float64 // exact pitches for the next note on each key
+}
+
+type synthVoice struct {
+	output     int
+	channel    uint8
+	key        uint8
+	pitch      float64 // in midi note numbers, not including pitch bend
+	gain       float64
+	percussion bool // noise burst, used for drums without a SoundFont
+	released   bool
+	level      float64 // envelope level
+	decaying   bool    // true once attack is done
+	phase      float64
+
+	// only used when playing a SoundFont
+	region  *sf2Region
+	pos     float64 // position in sample data
+	envTime float64 // seconds since note on
+}
+
+// create a synth that writes a WAV file with numOutputs independent sets of
+// midi channels mixed together. font can be nil.
+func newSynth(params synthParams, font *soundFont, w io.WriteSeeker, numOutputs int) *synth {
+	sy := &synth{
+		params:   params,
+		font:     font,
+		file:     w,
+		out:      bufio.NewWriter(w),
+		channels: make([][numMidiChannels]*synthChannel, numOutputs),
+		noise:    rand.New(rand.NewSource(1)), // deterministic output
+	}
+	for i := range sy.channels {
+		for j := range sy.channels[i] {
+			sy.channels[i][j] = newSynthChannel()
+		}
+	}
+	// placeholder until sizes are known
+	sy.setErr(writeWAVHeader(sy.out, params, 0))
+	return sy
+}
+
+func newSynthChannel() *synthChannel {
+	return &synthChannel{
+		volume:     100,
+		expression: 127,
+		pan:        64,
+		bendRange:  synthDefaultBend,
+		rpn:        [2]uint8{0x7f, 0x7f},
+		exact:      make(map[uint8]float64),
+	}
+}
+
+// return the channel's pitch bend in semitones
+func (sc *synthChannel) bendSemitones() float64 {
+	return float64(sc.bend) / 8192 * sc.bendRange
+}
+
+// return one midi writer per output
+func (sy *synth) writers() []writer.ChannelWriter {
+	wrs := make([]writer.ChannelWriter, len(sy.channels))
+	for i := range wrs {
+		wrs[i] = &synthWriter{synth: sy, output: i}
+	}
+	return wrs
+}
+
+func (sy *synth) setErr(err error) {
+	if sy.err == nil {
+		sy.err = err
+	}
+}
+
+// handle a midi message on an output
+func (sy *synth) handle(output int, msg midi.Message) {
+	switch msg := msg.(type) {
+	case channel.NoteOn:
+		if msg.Velocity() == 0 {
+			sy.noteOff(output, msg.Channel(), msg.Key())
+		} else {
+			sy.noteOn(output, msg.Channel(), msg.Key(), msg.Velocity())
+		}
+	case channel.NoteOff:
+		sy.noteOff(output, msg.Channel(), msg.Key())
+	case channel.NoteOffVelocity:
+		sy.noteOff(output, msg.Channel(), msg.Key())
+	case channel.ControlChange:
+		sy.controlChange(output, msg.Channel(), msg.Controller(), msg.Value())
+	case channel.Pitchbend:
+		sy.channels[output][msg.Channel()].bend = msg.Value()
+	case channel.ProgramChange:
+		sy.channels[output][msg.Channel()].program = msg.Program()
+	}
+}
+
+func (sy *synth) noteOn(output int, ch, key, velocity uint8) {
+	sy.noteOff(output, ch, key) // retrigger
+	sc := sy.channels[output][ch]
+	pitch := float64(key)
+	if p, ok := sc.exact[key]; ok {
+		pitch = p - sc.bendSemitones()
+		delete(sc.exact, key)
+	}
+	gain := float64(velocity) / 127
+	gain *= gain
+	if sy.font == nil {
+		sy.voices = append(sy.voices, &synthVoice{
+			output:     output,
+			channel:    ch,
+			key:        key,
+			pitch:      pitch,
+			gain:       gain,
+			percussion: ch == percussionChannelIndex,
+		})
+		return
+	}
+	bank := uint16(sc.bank)
+	if ch == percussionChannelIndex {
+		bank = sf2PercussionBank
+	}
+	if preset := sy.font.preset(bank, uint16(sc.program)); preset != nil {
+		for _, r := range preset.regionsFor(key, velocity) {
+			sy.voices = append(sy.voices, &synthVoice{
+				output:  output,
+				channel: ch,
+				key:     key,
+				pitch:   pitch,
+				gain:    gain * math.Pow(10, -r.attenuation/200),
+				region:  r,
+				pos:     float64(r.start),
+			})
+		}
+	}
+}
+
+func (sy *synth) noteOff(output int, ch, key uint8) {
+	for _, v := range sy.voices {
+		if v.output == output && v.channel == ch && v.key == key && !v.percussion {
+			v.released = true
+		}
+	}
+}
+
+func (sy *synth) controlChange(output int, ch, cc, value uint8) {
+	sc := sy.channels[output][ch]
+	switch cc {
+	case ccBankMSB:
+		sc.bank = value
+	case 7:
+		sc.volume = value
+	case 10:
+		sc.pan = value
+	case 11:
+		sc.expression = value
+	case 101:
+		sc.rpn[0] = value
+	case 100:
+		sc.rpn[1] = value
+	case 6: // data entry MSB
+		if sc.rpn == [2]uint8{0, 0} {
+			sc.bendRange = float64(value) + math.Mod(sc.bendRange, 1)
+		}
+	case 38: // data entry LSB
+		if sc.rpn == [2]uint8{0, 0} {
+			sc.bendRange = math.Floor(sc.bendRange) + float64(value)/100
+		}
+	case ccResetAllControllers:
+		sc.expression, sc.bend, sc.rpn = 127, 0, [2]uint8{0x7f, 0x7f}
+	case ccAllNotesOff:
+		for _, v := range sy.voices {
+			if v.output == output && v.channel == ch {
+				v.released = true
+			}
+		}
+	}
+}
+
+// set the exact pitch of a sounding or upcoming note
+func (sy *synth) setExactPitch(output int, ch, key uint8, pitch float64) {
+	sc := sy.channels[output][ch]
+	sc.exact[key] = pitch
+	for _, v := range sy.voices {
+		if v.output == output && v.channel == ch && v.key == key && !v.released {
+			v.pitch = pitch - sc.bendSemitones()
+		}
+	}
+}
+
+// render audio up to a point in time
+func (sy *synth) renderTo(t time.Duration) {
+	sy.render(int64(t) * int64(sy.params.sampleRate) / int64(time.Second))
+}
+
+// render audio up to a frame number
+func (sy *synth) render(frame int64) {
+	if frame <= sy.frames || sy.err != nil {
+		return
+	}
+	rate := float64(sy.params.sampleRate)
+	attack := 1 / math.Max(1, float64(sy.params.attack)*rate/1000)
+	decay := 1 / math.Max(1, float64(sy.params.decay)*rate/1000)
+	release := 1 / math.Max(1, float64(sy.params.release)*rate/1000)
+	sustain := float64(sy.params.sustain) / 100
+	drumDecay := math.Pow(0.001, 1/(synthDrumDecay*rate))
+
+	// channel state can't change during rendering, so compute per-voice
+	// constants up front
+	type voiceParams struct{ left, right, inc, decay, release float64 }
+	vps := make([]voiceParams, len(sy.voices))
+	for i, v := range sy.voices {
+		sc := sy.channels[v.output][v.channel]
+		vol, expr := float64(sc.volume)/127, float64(sc.expression)/127
+		pan := math.Max(0, float64(sc.pan)-1) / 126
+		gain := v.gain * vol * vol * expr * expr * synthHeadroom
+		pitch := v.pitch + sc.bendSemitones()
+		vp := voiceParams{inc: pitchToHz(pitch) / rate}
+		if r := v.region; r != nil {
+			pan = math.Max(0, math.Min(1, pan+r.pan))
+			vp.inc = math.Pow(2, ((pitch-r.rootKey)*r.scaleTuning+r.tune)/1200) *
+				r.sampleRate / rate
+			// decay and release are 100 dB over their duration
+			vp.decay = math.Pow(1e-5, 1/(r.decay*rate))
+			vp.release = math.Pow(1e-5, 1/(r.release*rate))
+		}
+		vp.left, vp.right = gain*math.Cos(pan*math.Pi/2), gain*math.Sin(pan*math.Pi/2)
+		vps[i] = vp
+	}
+
+	for ; sy.frames < frame; sy.frames++ {
+		var left, right float64
+		for i, v := range sy.voices {
+			var x float64
+			if v.region != nil {
+				x = v.nextRegionSample(sy.font.samples, vps[i].inc, 1/rate)
+				v.updateRegionEnvelope(1/rate, vps[i].decay, vps[i].release)
+			} else if v.percussion {
+				if !v.decaying {
+					v.level, v.decaying = 1, true
+				}
+				x = sy.noise.Float64()*2 - 1
+				v.level *= drumDecay
+				if v.level < 0.001 {
+					v.level, v.released = 0, true
+				}
+			} else {
+				x = oscillator(sy.params.waveform, v.phase, vps[i].inc)
+				v.phase = math.Mod(v.phase+vps[i].inc, 1)
+				if v.released {
+					v.level = math.Max(0, v.level-release)
+				} else if !v.decaying {
+					if v.level += attack; v.level >= 1 {
+						v.level, v.decaying = 1, true
+					}
+				} else if v.level > sustain {
+					v.level = math.Max(sustain, v.level-decay*(1-sustain))
+				}
+			}
+			left += x * v.level * vps[i].left
+			right += x * v.level * vps[i].right
+		}
+		sy.writeSample(left)
+		sy.writeSample(right)
+	}
+
+	// remove finished voices
+	voices := sy.voices[:0]
+	for _, v := range sy.voices {
+		if !v.released || v.level > 0 {
+			voices = append(voices, v)
+		}
+	}
+	sy.voices = voices
+}
+
+// return the next sample of a voice playing a SoundFont region, or 0 if the
+// sample has ended
+func (v *synthVoice) nextRegionSample(samples []int16, inc, dt float64) float64 {
+	r := v.region
+	i := int(v.pos)
+	looping := r.loopMode == 1 || (r.loopMode == 3 && !v.released)
+	if !looping && i+1 >= r.end {
+		v.released, v.level = true, 0
+		return 0
+	}
+	next := i + 1
+	if looping && next >= r.loopEnd {
+		next = r.loopStart
+	}
+	frac := v.pos - float64(i)
+	x := (float64(samples[i])*(1-frac) + float64(samples[next])*frac) / 32768
+	v.pos += inc
+	if looping && v.pos >= float64(r.loopEnd) {
+		v.pos -= float64(r.loopEnd - r.loopStart)
+	}
+	return x
+}
+
+// advance the envelope of a voice playing a SoundFont region by dt seconds,
+// using per-sample decay and release multipliers
+func (v *synthVoice) updateRegionEnvelope(dt, decay, release float64) {
+	r := v.region
+	v.envTime += dt
+	if v.released {
+		if v.level *= release; v.level < 1e-5 {
+			v.level = 0
+		}
+	} else if v.envTime < r.delay {
+		v.level = 0
+	} else if v.envTime < r.delay+r.attack {
+		v.level = (v.envTime - r.delay) / r.attack
+	} else if !v.decaying {
+		v.level = 1
+		v.decaying = v.envTime >= r.delay+r.attack+r.hold
+	} else {
+		v.level = math.Max(r.sustain, v.level*decay)
+	}
+}
+
+// return a sample of a waveform at a phase in [0, 1), band-limiting
+// discontinuities based on the phase increment
+func oscillator(waveform string, phase, inc float64) float64 {
+	switch waveform {
+	case "saw":
+		return 2*phase - 1 - polyBLEP(phase, inc)
+	case "square":
+		x := 1.0
+		if phase >= 0.5 {
+			x = -1
+		}
+		return x + polyBLEP(phase, inc) - polyBLEP(math.Mod(phase+0.5, 1), inc)
+	}
+	return math.Sin(2 * math.Pi * phase)
+}
+
+// polynomial correction for a unit step at phase 0
+func polyBLEP(phase, inc float64) float64 {
+	if phase < inc {
+		t := phase / inc
+		return t + t - t*t - 1
+	} else if phase > 1-inc {
+		t := (phase - 1) / inc
+		return t*t + t + t + 1
+	}
+	return 0
+}
+
+// write a clamped sample in the configured bit depth
+func (sy *synth) writeSample(x float64) {
+	x = math.Max(-1, math.Min(1, x))
+	var b [3]byte
+	if sy.params.bitDepth == 24 {
+		n := uint32(int32(math.Round(x * 0x7fffff)))
+		b = [3]byte{byte(n), byte(n >> 8), byte(n >> 16)}
+		_, err := sy.out.Write(b[:])
+		sy.setErr(err)
+	} else {
+		n := uint16(int16(math.Round(x * 0x7fff)))
+		_, err := sy.out.Write([]byte{byte(n), byte(n >> 8)})
+		sy.setErr(err)
+	}
+}
+
+// release all notes, render until they finish, and fill in the WAV header
+func (sy *synth) finish() error {
+	for _, v := range sy.voices {
+		v.released = true
+	}
+	end := sy.frames + int64(synthTailLimit*sy.params.sampleRate)
+	for len(sy.voices) > 0 && sy.frames < end && sy.err == nil {
+		sy.render(sy.frames + int64(sy.params.sampleRate/100))
+	}
+	if err := sy.out.Flush(); err != nil {
+		return err
+	}
+	if sy.err != nil {
+		return sy.err
+	}
+	if _, err := sy.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	dataSize := sy.frames * 2 * int64(sy.params.bitDepth/8)
+	return writeWAVHeader(sy.file, sy.params, uint32(dataSize))
+}
+
+// write the header of a stereo PCM WAV file
+func writeWAVHeader(w io.Writer, params synthParams, dataSize uint32) error {
+	blockAlign := 2 * params.bitDepth / 8
+	return binary.Write(w, binary.LittleEndian, struct {
+		RiffID        [4]byte
+		RiffSize      uint32
+		WaveID        [4]byte
+		FmtID         [4]byte
+		FmtSize       uint32
+		Format        uint16
+		Channels      uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+		DataID        [4]byte
+		DataSize      uint32
+	}{
+		[4]byte{'R', 'I', 'F', 'F'},
+		wavHeaderSize - 8 + dataSize,
+		[4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '},
+		16,
+		1, // PCM
+		2,
+		uint32(params.sampleRate),
+		uint32(params.sampleRate * blockAlign),
+		uint16(blockAlign),
+		uint16(params.bitDepth),
+		[4]byte{'d', 'a', 't', 'a'},
+		dataSize,
+	})
+}
+
+// midi writer for one output of a synth. the player advances its clock.
+type synthWriter struct {
+	synth   *synth
+	output  int
+	channel uint8
+	clock   time.Duration
+}
+
+func (sw *synthWriter) Channel() uint8 {
+	return sw.channel
+}
+
+func (sw *synthWriter) SetChannel(ch uint8) {
+	sw.channel = ch
+}
+
+func (sw *synthWriter) Write(msg midi.Message) error {
+	sw.synth.handle(sw.output, msg)
+	return nil
+}
+
+// move the clock to a time since playback started, rendering audio up to it.
+// since all outputs advance together, rendering only happens once.
+func (sw *synthWriter) advanceTo(t time.Duration) {
+	sw.clock = t
+	sw.synth.renderTo(sw.clock)
+}
+
+func (sw *synthWriter) setExactPitch(key uint8, pitch float64) {
+	sw.synth.setExactPitch(sw.output, sw.channel, key, pitch)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// render a song and return its header fields and left and right samples
+func renderTestWAV(t *testing.T, sng *song) ([]uint32, []float64, []float64) {
+	path := filepath.Join(t.TempDir(), "song.wav")
+	assert.Nil(t, sng.exportWAV(path))
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "RIFF", string(b[0:4]))
+	assert.Equal(t, "WAVE", string(b[8:12]))
+	assert.Equal(t, "data", string(b[36:40]))
+	header := []uint32{
+		binary.LittleEndian.Uint32(b[4:]),
+		binary.LittleEndian.Uint32(b[24:]),
+		uint32(binary.LittleEndian.Uint16(b[34:])),
+		binary.LittleEndian.Uint32(b[40:]),
+	}
+	var left, right []float64
+	for i := wavHeaderSize; i+4 <= len(b); i += 4 {
+		left = append(left, float64(int16(binary.LittleEndian.Uint16(b[i:])))/0x7fff)
+		right = append(right, float64(int16(binary.LittleEndian.Uint16(b[i+2:])))/0x7fff)
+	}
+	return header, left, right
+}
+
+// estimate frequency from upward zero crossings in a range of samples
+func zeroCrossingFreq(samples []float64, rate int) float64 {
+	first, last, n := -1, -1, 0
+	for i := 1; i < len(samples); i++ {
+		if samples[i-1] < 0 && samples[i] >= 0 {
+			if first == -1 {
+				first = i
+			} else {
+				n++
+			}
+			last = i
+		}
+	}
+	return float64(n) * float64(rate) / float64(last-first)
+}
+
+func TestExportWAV(t *testing.T) {
+	defer func(sp synthParams) { synthOptions = sp }(synthOptions)
+	synthOptions = synthParams{sampleRate: 44100, bitDepth: 16, waveform: "sine",
+		attack: 5, decay: 10, sustain: 50, release: 10}
+	sng := newSong(nil)
+	sng.Tracks[0].Events = []*trackEvent{
+		{Type: controllerEvent, ByteData1: 10, ByteData2: 0},
+		{Type: noteOnEvent, FloatData: 69.5, ByteData1: 127},
+		{Tick: ticksPerBeat / 2, Type: pitchBendEvent, FloatData: 81},
+		{Tick: ticksPerBeat, Type: noteOffEvent},
+	}
+	header, left, right := renderTestWAV(t, sng)
+	dataSize := uint32(len(left) * 4)
+	assert.Equal(t, []uint32{36 + dataSize, 44100, 16, dataSize}, header)
+
+	// one beat at 120 bpm, plus release
+	assert.InDelta(t, 0.51, float64(len(left))/44100, 0.01)
+
+	// panned hard left
+	assert.Greater(t, peak(left), 0.01)
+	assert.Less(t, peak(right), 0.001)
+
+	// exact pitches, before and after bend
+	assert.InDelta(t, 440*math.Pow(2, 0.5/12), zeroCrossingFreq(left[2205:11025], 44100), 0.5)
+	assert.InDelta(t, 880, zeroCrossingFreq(left[13230:22050], 44100), 0.5)
+}
+
+func TestSynthParamsValidate(t *testing.T) {
+	sp := synthParams{sampleRate: 44100, bitDepth: 24, waveform: "saw", sustain: 100}
+	assert.Nil(t, sp.validate())
+	sp.bitDepth = 8
+	assert.NotNil(t, sp.validate())
+	sp.bitDepth, sp.waveform = 16, "triangle"
+	assert.NotNil(t, sp.validate())
+}
+
+func peak(samples []float64) float64 {
+	x := 0.0
+	for _, s := range samples {
+		x = math.Max(x, math.Abs(s))
+	}
+	return x
+}
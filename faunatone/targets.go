@@ -1183,6 +1183,12 @@ var (
 
 		// MPE
 		commomDrumTargets,
+
+		// MTS
+		commomDrumTargets,
+
+		// MTS (NRT)
+		commomDrumTargets,
 	}
 
 	programCategories = []string{
@@ -1244,4 +1250,16 @@ func init() {
 			}
 		}
 	}
+
+	// MTS modes use the GM instrument and controller sets
+	for len(instrumentTargets) < numMidiModes {
+		instrumentTargets = append(instrumentTargets, nil)
+	}
+	for len(ccTargets) < numMidiModes {
+		ccTargets = append(ccTargets, nil)
+	}
+	for _, mode := range []int{modeMTS, modeMTSNonRealTime} {
+		instrumentTargets[mode] = instrumentTargets[modeGM]
+		ccTargets[mode] = ccTargets[modeGM]
+	}
 }
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModeTargets(t *testing.T) {
+	assert.Len(t, instrumentTargets, numMidiModes)
+	assert.Len(t, ccTargets, numMidiModes)
+	for _, mode := range []int{modeMTS, modeMTSNonRealTime} {
+		assert.Equal(t, instrumentTargets[modeGM], instrumentTargets[mode])
+		assert.Equal(t, ccTargets[modeGM], ccTargets[mode])
+	}
+	assert.NotEmpty(t, ccTargets[modeMPE])
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"slices"
+	"sort"
+)
+
+// a track's events are kept sorted by tick, with at most one event per tick,
+// so that lookups and range queries are binary searches. edits that add or
+// remove events build a new slice, so a slice returned by eventsInRange stays
+// valid after the track changes.
+
+// return the index of the first event at or after a tick
+func (t *track) searchTick(tick int64) int {
+	return sort.Search(len(t.Events), func(i int) bool {
+		return t.Events[i].Tick >= tick
+	})
+}
+
+// return the events in the tick range [tickMin, tickMax]. the slice shares
+// storage with the track and must not be modified.
+func (t *track) eventsInRange(tickMin, tickMax int64) []*trackEvent {
+	i := t.searchTick(tickMin)
+	j := i + sort.Search(len(t.Events)-i, func(k int) bool {
+		return t.Events[i+k].Tick > tickMax
+	})
+	return t.Events[i:j]
+}
+
+// return the event at the tick in the track, if any
+func (t *track) getEventAtTick(tick int64) *trackEvent {
+	if i := t.searchTick(tick); i < len(t.Events) && t.Events[i].Tick == tick {
+		return t.Events[i]
+	}
+	return nil
+}
+
+// return the tick of the first event after a tick, if any
+func (t *track) nextEventTick(tick int64) (int64, bool) {
+	if i := t.searchTick(tick + 1); i < len(t.Events) {
+		return t.Events[i].Tick, true
+	}
+	return 0, false
+}
+
+// add an event in place, replacing any event at the same tick. this is
+// cheapest when events are added in order, as when reading a file.
+func (t *track) insertEvent(te *trackEvent) {
+	i := t.searchTick(te.Tick)
+	if i < len(t.Events) && t.Events[i].Tick == te.Tick {
+		t.Events[i] = te
+	} else {
+		t.Events = slices.Insert(t.Events, i, te)
+	}
+}
+
+// add events, replacing any events at the same ticks. if several added events
+// share a tick, the last one is kept.
+func (t *track) addEvents(tes []*trackEvent) {
+	if len(tes) == 0 {
+		return
+	}
+	tes = slices.Clone(tes)
+	sort.SliceStable(tes, func(i, j int) bool {
+		return tes[i].Tick < tes[j].Tick
+	})
+	events := make([]*trackEvent, 0, len(t.Events)+len(tes))
+	i := 0
+	for j, te := range tes {
+		if j+1 < len(tes) && tes[j+1].Tick == te.Tick {
+			continue
+		}
+		k := i + sort.Search(len(t.Events)-i, func(k int) bool {
+			return t.Events[i+k].Tick >= te.Tick
+		})
+		events = append(events, t.Events[i:k]...)
+		i = k
+		if i < len(t.Events) && t.Events[i].Tick == te.Tick {
+			i++
+		}
+		events = append(events, te)
+	}
+	t.Events = append(events, t.Events[i:]...)
+}
+
+// remove the events at the given ticks, if any
+func (t *track) removeEvents(ticks []int64) {
+	if len(ticks) == 0 {
+		return
+	}
+	ticks = slices.Clone(ticks)
+	slices.Sort(ticks)
+	events := make([]*trackEvent, 0, len(t.Events))
+	i := 0
+	for _, tick := range ticks {
+		k := i + sort.Search(len(t.Events)-i, func(k int) bool {
+			return t.Events[i+k].Tick >= tick
+		})
+		events = append(events, t.Events[i:k]...)
+		i = k
+		if i < len(t.Events) && t.Events[i].Tick == tick {
+			i++
+		}
+	}
+	t.Events = append(events, t.Events[i:]...)
+}
+
+// sort events that weren't added through the methods above, keeping only the
+// last event at each tick
+func (t *track) sortEvents() {
+	sort.SliceStable(t.Events, func(i, j int) bool {
+		return t.Events[i].Tick < t.Events[j].Tick
+	})
+	events := t.Events[:0]
+	for i, te := range t.Events {
+		if i+1 < len(t.Events) && t.Events[i+1].Tick == te.Tick {
+			continue
+		}
+		events = append(events, te)
+	}
+	for i := len(events); i < len(t.Events); i++ {
+		t.Events[i] = nil
+	}
+	t.Events = events
+}
+
+// merge sorted event slices into one, ordered by tick and then by the index
+// of the slice each event came from
+func mergeEvents(lists [][]*trackEvent) []*trackEvent {
+	switch len(lists) {
+	case 0:
+		return nil
+	case 1:
+		return lists[0]
+	}
+	a, b := mergeEvents(lists[:len(lists)/2]), mergeEvents(lists[len(lists)/2:])
+	merged := make([]*trackEvent, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if b[0].Tick < a[0].Tick {
+			merged, b = append(merged, b[0]), b[1:]
+		} else {
+			merged, a = append(merged, a[0]), a[1:]
+		}
+	}
+	return append(append(merged, a...), b...)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/writer"
+)
+
+// return the ticks of a slice of events
+func eventTicks(tes []*trackEvent) []int64 {
+	ticks := []int64{}
+	for _, te := range tes {
+		ticks = append(ticks, te.Tick)
+	}
+	return ticks
+}
+
+func TestTrackEvents(t *testing.T) {
+	tr := newTrack(0, 0)
+	for _, tick := range []int64{30, 10, 20, 10} {
+		tr.insertEvent(&trackEvent{Tick: tick, Type: controllerEvent})
+	}
+	assert.Equal(t, []int64{10, 20, 30}, eventTicks(tr.Events))
+
+	assert.Equal(t, []int64{20, 30}, eventTicks(tr.eventsInRange(11, 30)))
+	assert.Empty(t, tr.eventsInRange(21, 29))
+	assert.Nil(t, tr.getEventAtTick(15))
+	assert.Equal(t, int64(20), tr.getEventAtTick(20).Tick)
+	tick, ok := tr.nextEventTick(20)
+	assert.Equal(t, int64(30), tick)
+	assert.True(t, ok)
+	_, ok = tr.nextEventTick(30)
+	assert.False(t, ok)
+
+	// added events replace existing ones, and the last of a tick wins
+	old := tr.Events
+	tr.addEvents([]*trackEvent{
+		{Tick: 40, Type: noteOnEvent},
+		{Tick: 0, Type: noteOnEvent},
+		{Tick: 20, Type: noteOnEvent},
+		{Tick: 20, Type: noteOffEvent},
+	})
+	assert.Equal(t, []int64{0, 10, 20, 30, 40}, eventTicks(tr.Events))
+	assert.Equal(t, noteOffEvent, tr.getEventAtTick(20).Type)
+	assert.Equal(t, controllerEvent, old[1].Type) // old slice is unchanged
+
+	tr.removeEvents([]int64{40, 5, 10})
+	assert.Equal(t, []int64{0, 20, 30}, eventTicks(tr.Events))
+
+	tr.Events = []*trackEvent{{Tick: 20}, {Tick: 10}, {Tick: 20, Type: noteOnEvent}}
+	tr.sortEvents()
+	assert.Equal(t, []int64{10, 20}, eventTicks(tr.Events))
+	assert.Equal(t, noteOnEvent, tr.Events[1].Type)
+}
+
+func TestMergeEvents(t *testing.T) {
+	lists := [][]*trackEvent{
+		{{Tick: 0, track: 0}, {Tick: 20, track: 0}},
+		{},
+		{{Tick: 10, track: 2}, {Tick: 20, track: 2}},
+		{{Tick: 0, track: 3}},
+	}
+	events := mergeEvents(lists)
+	assert.Equal(t, []int64{0, 0, 10, 20, 20}, eventTicks(events))
+	for i, track := range []int{0, 3, 2, 0, 2} {
+		assert.Equal(t, track, events[i].track)
+	}
+}
+
+func TestTickShift(t *testing.T) {
+	s := newSong(nil)
+	s.Tracks[0].Events = []*trackEvent{{Tick: 0}, {Tick: 240}, {Tick: 480}, {Tick: 960}}
+	pe := &patternEditor{song: s, division: 4, historyIndex: -1, historySizeLimit: 1e6,
+		cursorTickClick: 240, cursorTickDrag: 240}
+	pe.deleteDivision()
+	assert.Equal(t, []int64{0, 240, 720}, eventTicks(s.Tracks[0].Events))
+	assert.Nil(t, pe.undo())
+	assert.Equal(t, []int64{0, 240, 480, 960}, eventTicks(s.Tracks[0].Events))
+}
+
+// channel writer that drops everything
+type discardWriter struct {
+	channel uint8
+}
+
+func (dw *discardWriter) Channel() uint8           { return dw.channel }
+func (dw *discardWriter) SetChannel(ch uint8)      { dw.channel = ch }
+func (dw *discardWriter) Write(midi.Message) error { return nil }
+
+// return a song with notes and dense interpolated bend and controller data,
+// totaling about 120,000 events
+func denseSong() *song {
+	s := newSong(nil)
+	for i := 1; i < 4; i++ {
+		s.Tracks = append(s.Tracks, newTrack(uint8(i), i))
+	}
+	for i, tr := range s.Tracks {
+		for tick := int64(0); tick < ticksPerBeat*1000; tick += ticksPerBeat / 32 {
+			te := &trackEvent{Tick: tick, Type: pitchBendEvent, FloatData: 60, track: i}
+			switch {
+			case i%2 == 1:
+				te.Type, te.ByteData1, te.ByteData2 = controllerEvent, 1, byte(tick%128)
+			case tick%ticksPerBeat == 0:
+				te.Type, te.ByteData1 = noteOnEvent, 100
+			}
+			tr.Events = append(tr.Events, te)
+		}
+	}
+	return s
+}
+
+func BenchmarkPlayback(b *testing.B) {
+	s := denseSong()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := newPlayer(s, []writer.ChannelWriter{&discardWriter{}}, false)
+		go p.run()
+		p.sendStopping = true
+		p.signal <- playerSignal{typ: signalStart}
+		<-p.stopping
+	}
+}
+
+func BenchmarkStartMidSong(b *testing.B) {
+	s := denseSong()
+	p := newPlayer(s, []writer.ChannelWriter{&discardWriter{}}, false)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.determineVirtualChannelStates(ticksPerBeat * 500)
+	}
+}
+
+func BenchmarkEditAndUndo(b *testing.B) {
+	s := denseSong()
+	pe := &patternEditor{song: s, division: 4, historyIndex: -1, historySizeLimit: 1e6,
+		cursorTickClick: ticksPerBeat * 500, cursorTickDrag: ticksPerBeat * 501,
+		cursorTrackDrag: 1}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pe.transposeSelection(1)
+		pe.undo()
+	}
+}
+
+func BenchmarkSelection(b *testing.B) {
+	s := denseSong()
+	pe := &patternEditor{song: s, cursorTickClick: ticksPerBeat * 500,
+		cursorTickDrag: ticksPerBeat * 504, cursorTrackDrag: len(s.Tracks) - 1}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pe.copy()
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// AnaMark .tun tuning files. only the [Tuning] and [Exact Tuning] sections are
+// read; [Exact Tuning] takes precedence where both give a note.
+
+// frequency of midi note 0 in 12edo, which [Tuning] values are relative to,
+// and the default base frequency of [Exact Tuning] values
+const tunBaseFreq = 8.1757989156437073336
+
+// return the absolute pitch of a frequency
+func freqToPitch(f float64) float64 {
+	return 12 * math.Log2(f/tunBaseFreq)
+}
+
+// parse the contents of a .tun file, returning the absolute pitch of each midi
+// note
+func parseTun(r io.Reader) ([128]float64, error) {
+	var pitches [128]float64
+	var exact [128]bool
+	for i := range pitches {
+		pitches[i] = float64(i)
+	}
+	section := ""
+	baseFreq := tunBaseFreq
+	sawTuning := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, ";"); i != -1 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || (section != "tuning" && section != "exact tuning") {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if key == "basefreq" && section == "exact tuning" {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil || f <= 0 {
+				return pitches, fmt.Errorf("invalid base frequency: %s", value)
+			}
+			baseFreq = f
+			continue
+		}
+		if !strings.HasPrefix(key, "note ") {
+			continue
+		}
+		note, err := strconv.Atoi(strings.TrimSpace(key[len("note "):]))
+		if err != nil || note < 0 || note >= len(pitches) {
+			return pitches, fmt.Errorf("invalid note: %s", key)
+		}
+		cents, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return pitches, fmt.Errorf("invalid tuning for note %d: %s", note, value)
+		}
+		if section == "exact tuning" {
+			pitches[note], exact[note] = cents/100, true
+		} else if !exact[note] {
+			pitches[note] = cents / 100
+		}
+		sawTuning = true
+	}
+	if err := scanner.Err(); err != nil {
+		return pitches, err
+	}
+	if !sawTuning {
+		return pitches, fmt.Errorf("no tuning data in file")
+	}
+	// exact note values are relative to the base frequency
+	for i := range pitches {
+		if exact[i] {
+			pitches[i] += freqToPitch(baseFreq)
+		}
+	}
+	return pitches, nil
+}
+
+// convert a .tun file into a keymap with only midi mappings, also returning
+// the absolute pitch of midi note 60, which is used as the root
+func keymapFromTunFile(path string) (*keymap, float64, error) {
+	f, err := os.Open(joinTreePath(keymapPath, path))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	pitches, err := parseTun(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	k, root := keymapFromPitches(strings.TrimSuffix(filepath.Base(path), ".tun"), pitches)
+	return k, root, nil
+}
+
+// return a keymap that maps each midi note to an absolute pitch, relative to
+// the pitch of midi note 60, which is returned as the root
+func keymapFromPitches(name string, pitches [128]float64) (*keymap, float64) {
+	k := newEmptyKeymap(name)
+	root := pitches[60]
+	for i, p := range pitches {
+		k.Items = append(k.Items,
+			newKeyInfo(fmt.Sprintf("m%d", i), false, "", newSemiPitch(p-root)))
+	}
+	k.setMidiPattern()
+	return k, root
+}
+
+// return the text of a .tun file with the keymap's midi mappings relative to a
+// root pitch. unmapped keys keep their 12edo pitches.
+func (k *keymap) formatTun(name string, refPitch float64) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "; %s.tun\n", name)
+	fmt.Fprintf(&b, "[Scale Begin]\n")
+	fmt.Fprintf(&b, "Format= \"AnaMark-TUN\"\n")
+	fmt.Fprintf(&b, "FormatVersion= 200\n")
+	fmt.Fprintf(&b, "FormatSpecs= \"http://www.mark-henning.de/eternity/tuningspecs.html\"\n\n")
+	fmt.Fprintf(&b, "[Info]\n")
+	fmt.Fprintf(&b, "Name= %s\n\n", strconv.Quote(name))
+	pitches := make([]float64, len(k.midimap))
+	for i, p := range k.midimap {
+		pitches[i] = refPitch + p
+		if k.midiUnmap[i] {
+			pitches[i] = float64(i)
+		}
+	}
+	// v1 readers only understand integer cents
+	fmt.Fprintf(&b, "[Tuning]\n")
+	for i, p := range pitches {
+		fmt.Fprintf(&b, "note %d= %d\n", i, int(math.Round(p*100)))
+	}
+	fmt.Fprintf(&b, "\n[Exact Tuning]\n")
+	fmt.Fprintf(&b, "BaseFreq= %.10f\n", tunBaseFreq)
+	for i, p := range pitches {
+		fmt.Fprintf(&b, "note %d= %.6f\n", i, p*100)
+	}
+	fmt.Fprintf(&b, "\n[Scale End]\n")
+	return b.String()
+}
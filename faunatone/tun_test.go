@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTun(t *testing.T) {
+	k, err := genRank2Keymap(newRatPitch(2, 1), newRatPitch(3, 2), 7)
+	assert.Nil(t, err)
+	k.midiUnmap[0] = true
+	text := k.formatTun("test", 62)
+	pitches, err := parseTun(bytes.NewBufferString(text))
+	assert.Nil(t, err)
+	assert.InDelta(t, 0.0, pitches[0], 0.000001)
+	for i := 1; i < 128; i++ {
+		assert.InDelta(t, 62+k.midimap[i], pitches[i], 0.000001)
+	}
+
+	k2, root := keymapFromPitches("test", pitches)
+	assert.InDelta(t, 62.0, root, 0.000001)
+	for i := 1; i < 128; i++ {
+		assert.InDelta(t, k.midimap[i], k2.midimap[i], 0.000001)
+	}
+
+	// v1 files, comments, and base frequency
+	pitches, err = parseTun(bytes.NewBufferString(`; comment
+[Tuning]
+note 69= 6950 ; quarter tone sharp
+[Exact Tuning]
+BaseFreq= 16.3515978312874
+note 60= 50
+`))
+	assert.Nil(t, err)
+	assert.InDelta(t, 69.5, pitches[69], 0.000001)
+	assert.InDelta(t, 12.5, pitches[60], 0.000001)
+	assert.InDelta(t, 61.0, pitches[61], 0.000001)
+
+	_, err = parseTun(bytes.NewBufferString("[Info]\nName= \"x\"\n"))
+	assert.NotNil(t, err)
+}
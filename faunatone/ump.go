@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+	"os"
+
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/midimessage/channel"
+	"gitlab.com/gomidi/midi/midimessage/meta"
+	sysexmsg "gitlab.com/gomidi/midi/midimessage/sysex"
+	"gitlab.com/gomidi/midi/writer"
+)
+
+// MIDI 2.0 Universal MIDI Packet output. the player drives a umpWriter like
+// any other midi writer, and it translates MIDI 1.0 messages into MIDI 2.0
+// channel voice messages. notes get their exact pitches from per-note pitch
+// controllers, so the player gives each virtual channel its own channel and
+// picks free note numbers as in the MTS modes.
+
+const (
+	midiClipExt    = ".midi2"
+	midiClipHeader = "SMF2CLIP"
+
+	// message types
+	umpUtility       = 0x0
+	umpData64        = 0x3 // 7-bit system exclusive
+	umpMIDI2Channel  = 0x4
+	umpFlexData      = 0xd
+	umpStreamMessage = 0xf
+
+	// utility statuses
+	umpDCTPQ           = 0x3 // delta clockstamp ticks per quarter note
+	umpDeltaClockstamp = 0x4
+
+	// stream statuses
+	umpStartOfClip = 0x20
+	umpEndOfClip   = 0x21
+
+	// MIDI 2.0 channel voice statuses
+	umpRegPerNoteController = 0x0
+	umpRPN                  = 0x2
+	umpNoteOff              = 0x8
+	umpNoteOn               = 0x9
+	umpPolyPressure         = 0xa
+	umpControlChange        = 0xb
+	umpProgramChange        = 0xc
+	umpChannelPressure      = 0xd
+	umpPitchBend            = 0xe
+
+	umpPerNotePitch     = 3    // registered per-note controller, pitch 7.25
+	umpAttributePitch79 = 0x03 // note on/off attribute type, pitch 7.9
+
+	umpMaxDelta = 1<<20 - 1
+)
+
+// shared destination for the packets of all writers in an export
+type umpStream struct {
+	w        *bufio.Writer
+	lastTick int64
+	err      error // first write error, if any
+}
+
+// write a packet, preceded by a delta clockstamp for the time since the last
+// packet. the clip format wants one before every packet, even if it's 0.
+func (us *umpStream) write(tick int64, words ...uint32) {
+	var delta int64
+	if tick > us.lastTick {
+		delta, us.lastTick = tick-us.lastTick, tick
+	}
+	for delta > umpMaxDelta {
+		us.writeWords(umpUtility<<28 | umpDeltaClockstamp<<20 | umpMaxDelta)
+		delta -= umpMaxDelta
+	}
+	us.writeWords(umpUtility<<28 | umpDeltaClockstamp<<20 | uint32(delta))
+	us.writeWords(words...)
+}
+
+func (us *umpStream) writeWords(words ...uint32) {
+	if us.err == nil {
+		us.err = binary.Write(us.w, binary.BigEndian, words)
+	}
+}
+
+// midi writer that emits UMPs for one group, which corresponds to an output
+type umpWriter struct {
+	stream  *umpStream
+	group   uint8
+	channel uint8
+	tick    int64 // set by the player
+
+	// per-channel state needed for translation
+	bank    [numMidiChannels][2]uint8 // MSB, LSB
+	rpn     [numMidiChannels][2]uint8 // MSB, LSB
+	dataMSB [numMidiChannels]uint8
+	pitch   [numMidiChannels]map[uint8]float64 // exact pitches by key
+	notes   [numMidiChannels][128]bool
+}
+
+func newUMPWriter(stream *umpStream, group uint8) *umpWriter {
+	uw := &umpWriter{stream: stream, group: group}
+	for i := range uw.pitch {
+		uw.pitch[i] = make(map[uint8]float64)
+		uw.rpn[i] = [2]uint8{0x7f, 0x7f}
+	}
+	return uw
+}
+
+func (uw *umpWriter) Channel() uint8 {
+	return uw.channel
+}
+
+func (uw *umpWriter) SetChannel(ch uint8) {
+	uw.channel = ch
+}
+
+// write a MIDI 2.0 channel voice message
+func (uw *umpWriter) writeVoice(status, ch, index1, index2 uint8, data uint32) {
+	uw.stream.write(uw.tick,
+		umpMIDI2Channel<<28|uint32(uw.group)<<24|uint32(status)<<20|uint32(ch)<<16|
+			uint32(index1)<<8|uint32(index2),
+		data)
+}
+
+func (uw *umpWriter) Write(msg midi.Message) error {
+	switch msg := msg.(type) {
+	case channel.NoteOn:
+		if msg.Velocity() == 0 {
+			uw.noteOff(msg.Channel(), msg.Key())
+			break
+		}
+		ch, key := msg.Channel(), msg.Key()
+		p, ok := uw.pitch[ch][key]
+		if !ok {
+			p = float64(key)
+		}
+		uw.writeVoice(umpRegPerNoteController, ch, key, umpPerNotePitch, pitch725(p))
+		uw.writeVoice(umpNoteOn, ch, key, umpAttributePitch79,
+			uint32(scaleUp(uint32(msg.Velocity()), 7, 16))<<16|uint32(pitch79(p)))
+		uw.notes[ch][key] = true
+	case channel.NoteOff:
+		uw.noteOff(msg.Channel(), msg.Key())
+	case channel.NoteOffVelocity:
+		uw.noteOff(msg.Channel(), msg.Key())
+	case channel.PolyAftertouch:
+		uw.writeVoice(umpPolyPressure, msg.Channel(), msg.Key(), 0,
+			scaleUp(uint32(msg.Pressure()), 7, 32))
+	case channel.Aftertouch:
+		uw.writeVoice(umpChannelPressure, msg.Channel(), 0, 0,
+			scaleUp(uint32(msg.Pressure()), 7, 32))
+	case channel.Pitchbend:
+		uw.writeVoice(umpPitchBend, msg.Channel(), 0, 0,
+			scaleUp(uint32(msg.AbsValue()), 14, 32))
+	case channel.ProgramChange:
+		bank := uw.bank[msg.Channel()]
+		uw.writeVoice(umpProgramChange, msg.Channel(), 0, 1, // bank valid
+			uint32(msg.Program())<<24|uint32(bank[0])<<8|uint32(bank[1]))
+	case channel.ControlChange:
+		uw.controlChange(msg.Channel(), msg.Controller(), msg.Value())
+	case sysexmsg.SysEx:
+		uw.writeSysEx(msg.Data())
+	case meta.Tempo:
+		// 10 ns units per quarter note
+		uw.writeFlexData(0, 0, []uint32{uint32(math.Round(6e9 / msg.FractionalBPM()))})
+	case meta.Copyright:
+		uw.writeFlexText(1, 0x04, string(msg))
+	case meta.TrackSequenceName:
+		uw.writeFlexText(1, 0x03, string(msg)) // clip name
+	case meta.Lyric:
+		uw.writeFlexText(2, 0x01, string(msg))
+	case meta.Text:
+		uw.writeFlexText(1, 0x00, string(msg))
+	case meta.Instrument:
+		uw.writeFlexText(1, 0x00, string(msg))
+	case meta.Marker:
+		uw.writeFlexText(1, 0x00, string(msg))
+	case meta.Cuepoint:
+		uw.writeFlexText(1, 0x00, string(msg))
+	case meta.Program:
+		uw.writeFlexText(1, 0x00, string(msg))
+	case meta.Device:
+		uw.writeFlexText(1, 0x00, string(msg))
+	}
+	return uw.stream.err
+}
+
+func (uw *umpWriter) noteOff(ch, key uint8) {
+	p, ok := uw.pitch[ch][key]
+	if !ok {
+		p = float64(key)
+	}
+	uw.writeVoice(umpNoteOff, ch, key, umpAttributePitch79, uint32(pitch79(p)))
+	uw.notes[ch][key] = false
+	delete(uw.pitch[ch], key)
+}
+
+// translate a control change. bank select and RPN data entry are folded
+// into program change and RPN messages.
+func (uw *umpWriter) controlChange(ch, cc, value uint8) {
+	switch cc {
+	case ccBankMSB:
+		uw.bank[ch][0] = value
+	case ccBankLSB:
+		uw.bank[ch][1] = value
+	case rpnMSB:
+		uw.rpn[ch][0] = value
+	case rpnLSB:
+		uw.rpn[ch][1] = value
+	case nrpnMSB, nrpnLSB:
+		uw.rpn[ch] = [2]uint8{0x7f, 0x7f} // NRPNs aren't translated
+	case rpnDataMSB:
+		uw.dataMSB[ch] = value
+	case rpnDataLSB:
+		if uw.rpn[ch] != [2]uint8{0x7f, 0x7f} {
+			uw.writeVoice(umpRPN, ch, uw.rpn[ch][0], uw.rpn[ch][1],
+				scaleUp(uint32(uw.dataMSB[ch])<<7|uint32(value), 14, 32))
+		}
+	default:
+		uw.writeVoice(umpControlChange, ch, cc, 0, scaleUp(uint32(value), 7, 32))
+	}
+}
+
+// set the pitch of a key on the current channel. this applies to the next
+// note on, or immediately if the key is already sounding.
+func (uw *umpWriter) setExactPitch(key uint8, p float64) {
+	uw.pitch[uw.channel][key] = p
+	if uw.notes[uw.channel][key] {
+		uw.writeVoice(umpRegPerNoteController, uw.channel, key, umpPerNotePitch, pitch725(p))
+	}
+}
+
+// write a system exclusive message as 7-bit data packets
+func (uw *umpWriter) writeSysEx(data []byte) {
+	for i := 0; i == 0 || i < len(data); i += 6 {
+		n := intMin(6, len(data)-i)
+		status := uint32(0) // complete in one packet
+		if i == 0 && n < len(data) {
+			status = 1 // start
+		} else if i > 0 && i+n < len(data) {
+			status = 2 // continue
+		} else if i > 0 {
+			status = 3 // end
+		}
+		var b [6]byte
+		copy(b[:], data[i:i+n])
+		uw.stream.write(uw.tick,
+			umpData64<<28|uint32(uw.group)<<24|status<<20|uint32(n)<<16|
+				uint32(b[0])<<8|uint32(b[1]),
+			binary.BigEndian.Uint32(b[2:]))
+	}
+}
+
+// write a flex data message addressed to the whole group
+func (uw *umpWriter) writeFlexData(statusBank, status uint8, data []uint32) {
+	uw.writeFlexPacket(0, statusBank, status, data)
+}
+
+// write a flex data text message, split across packets as needed
+func (uw *umpWriter) writeFlexText(statusBank, status uint8, text string) {
+	b := []byte(text)
+	for i := 0; i == 0 || i < len(b); i += 12 {
+		n := intMin(12, len(b)-i)
+		form := uint8(0) // complete
+		if i == 0 && n < len(b) {
+			form = 1 // start
+		} else if i > 0 && i+n < len(b) {
+			form = 2 // continue
+		} else if i > 0 {
+			form = 3 // end
+		}
+		var chunk [12]byte
+		copy(chunk[:], b[i:i+n])
+		uw.writeFlexPacket(form, statusBank, status, []uint32{
+			binary.BigEndian.Uint32(chunk[0:]),
+			binary.BigEndian.Uint32(chunk[4:]),
+			binary.BigEndian.Uint32(chunk[8:]),
+		})
+	}
+}
+
+func (uw *umpWriter) writeFlexPacket(form, statusBank, status uint8, data []uint32) {
+	words := []uint32{
+		umpFlexData<<28 | uint32(uw.group)<<24 | uint32(form)<<22 | 1<<20 | // group address
+			uint32(statusBank)<<8 | uint32(status),
+		0, 0, 0,
+	}
+	copy(words[1:], data)
+	uw.stream.write(uw.tick, words...)
+}
+
+// return a pitch in MIDI 2.0 pitch 7.25 format
+func pitch725(p float64) uint32 {
+	return uint32(math.Round(math.Max(0, math.Min(127.99999997, p)) * (1 << 25)))
+}
+
+// return a pitch in MIDI 2.0 pitch 7.9 format
+func pitch79(p float64) uint16 {
+	return uint16(math.Round(math.Max(0, math.Min(127.998, p)) * (1 << 9)))
+}
+
+// scale a value to a larger bit width using the min-center-max method from
+// the MIDI 2.0 specification, so that minimum, center, and maximum values
+// stay minimum, center, and maximum
+func scaleUp(x uint32, srcBits, dstBits uint) uint32 {
+	scaleBits := dstBits - srcBits
+	shifted := x << scaleBits
+	if x <= 1<<(srcBits-1) {
+		return shifted
+	}
+	repeatBits := srcBits - 1
+	repeat := x & (1<<repeatBits - 1)
+	if scaleBits > repeatBits {
+		repeat <<= scaleBits - repeatBits
+	} else {
+		repeat >>= repeatBits - scaleBits
+	}
+	for repeat != 0 {
+		shifted |= repeat
+		repeat >>= repeatBits
+	}
+	return shifted
+}
+
+// export to a MIDI 2.0 clip file. each MIDI output is written to the UMP
+// group with the same index. if the polyphony limit was exceeded, the file is
+// still written and a *polyphonyError is returned.
+func (s *song) exportMIDIClip(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	stream := &umpStream{w: bufio.NewWriter(f)}
+	if _, err := stream.w.WriteString(midiClipHeader); err != nil {
+		f.Close()
+		return err
+	}
+	// clip configuration header, then the sequence
+	stream.writeWords(umpUtility<<28 | umpDCTPQ<<20 | ticksPerBeat)
+	stream.write(0, umpStreamMessage<<28|umpStartOfClip<<16, 0, 0, 0)
+
+	numOutputs := 1
+	for _, output := range s.usedOutputs() {
+		if output >= numOutputs {
+			numOutputs = output + 1
+		}
+	}
+	if numOutputs > 16 {
+		numOutputs = 16 // one group per output
+	}
+	wrs := make([]writer.ChannelWriter, numOutputs)
+	for i := range wrs {
+		wrs[i] = newUMPWriter(stream, uint8(i))
+	}
+	p := newPlayer(s, wrs, false)
+	go p.run()
+	p.sendStopping = true
+	p.signal <- playerSignal{typ: signalStart}
+	<-p.stopping
+
+	stream.write(p.lastTick, umpStreamMessage<<28|umpEndOfClip<<16, 0, 0, 0)
+	if stream.err == nil {
+		stream.err = stream.w.Flush()
+	}
+	if stream.err != nil {
+		f.Close()
+		return stream.err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if p.polyErrCount > 0 {
+		return &polyphonyError{p.polyErrCount}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScaleUp(t *testing.T) {
+	assert.Equal(t, uint32(0), scaleUp(0, 7, 16))
+	assert.Equal(t, uint32(0x8000), scaleUp(64, 7, 16))
+	assert.Equal(t, uint32(0xffff), scaleUp(127, 7, 16))
+	assert.Equal(t, uint32(0xffffffff), scaleUp(127, 7, 32))
+	assert.Equal(t, uint32(0x80000000), scaleUp(0x2000, 14, 32))
+}
+
+// return the packets in a clip file, split by size
+func readMIDIClip(t *testing.T, path string) [][]uint32 {
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, midiClipHeader, string(b[:8]))
+	var packets [][]uint32
+	for b = b[8:]; len(b) >= 4; {
+		size := []int{1, 1, 1, 2, 2, 4, 1, 1, 2, 2, 2, 3, 3, 4, 4, 4}[b[0]>>4]
+		packet := make([]uint32, size)
+		for i := range packet {
+			packet[i] = binary.BigEndian.Uint32(b[i*4:])
+		}
+		packets = append(packets, packet)
+		b = b[size*4:]
+	}
+	return packets
+}
+
+func TestExportMIDIClip(t *testing.T) {
+	// more simultaneous notes than MIDI 1.0 channels
+	s := newSong(nil)
+	s.Tracks = nil
+	for i := 0; i < 20; i++ {
+		s.Tracks = append(s.Tracks, newTrack(0, i))
+		s.Tracks[i].Events = []*trackEvent{
+			{Type: noteOnEvent, FloatData: 60 + float64(i)/3, ByteData1: 127, track: i},
+			{Tick: ticksPerBeat, Type: noteOffEvent, track: i},
+		}
+	}
+	s.Tracks[0].insertEvent(
+		&trackEvent{Tick: ticksPerBeat / 2, Type: pitchBendEvent, FloatData: 59.25})
+	path := filepath.Join(t.TempDir(), "test.midi2")
+	assert.Nil(t, s.writeFile(path))
+
+	packets := readMIDIClip(t, path)
+	assert.Equal(t, []uint32{0x003003c0}, packets[0])                       // DCTPQ
+	assert.Equal(t, []uint32{0x00400000}, packets[1])                       // DCS 0
+	assert.Equal(t, []uint32{0xf0200000, 0, 0, 0}, packets[2])              // start of clip
+	assert.Equal(t, []uint32{0xf0210000, 0, 0, 0}, packets[len(packets)-1]) // end of clip
+
+	// every packet in the sequence follows a delta clockstamp
+	for i := 2; i < len(packets); i++ {
+		isDCS := packets[i][0]>>20 == 0x004
+		assert.NotEqual(t, isDCS, packets[i-1][0]>>20 == 0x004, "packet %d", i)
+	}
+
+	var pitches []uint32
+	noteOns, noteOffs := 0, 0
+	for _, p := range packets {
+		switch p[0] & 0xfff000ff {
+		case 0x40000003: // per-note pitch controller
+			pitches = append(pitches, p[1])
+		case 0x40900003: // note on with pitch attribute
+			noteOns++
+			assert.Equal(t, uint32(0xffff), p[1]>>16)
+		case 0x40800003:
+			noteOffs++
+		}
+	}
+	assert.Equal(t, 20, noteOns)
+	assert.Equal(t, 20, noteOffs)
+	if assert.Len(t, pitches, 21) {
+		assert.Equal(t, uint32(60<<25), pitches[0])
+		assert.Equal(t, pitch725(60+19.0/3), pitches[19])
+		assert.Equal(t, uint32(59.25*(1<<25)), pitches[20]) // bend
+	}
+}